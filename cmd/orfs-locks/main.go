@@ -0,0 +1,108 @@
+// orfs-locks lists the locks held on the objects of an ORFS filesystem and
+// breaks locks left behind by clients which are gone.
+//
+//	orfs-locks [-config orfs.yaml] [-pool test] [-mdpool test_metadata] [-metrics-addr :9100] list
+//	orfs-locks [-config orfs.yaml] [-pool test] [-mdpool test_metadata] [-metrics-addr :9100] break <pool> <object> <lock> <client> <cookie>
+//
+// The filesystem is configured by the config file and the ORFS_ environment
+// variables, see orfs.Config, -pool, -mdpool and -metrics-addr override them.
+// With a metrics address the metrics are served at /metrics while the
+// command runs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/cetex/ORFS/orfs"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %v [flags] list\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %v [flags] break <pool> <object> <lock> <client> <cookie>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	config := flag.String("config", "", "YAML config file")
+	pool := flag.String("pool", "", "data pool (default test)")
+	mdpool := flag.String("mdpool", "", "metadata pool (default test_metadata)")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve metrics on at /metrics")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	cfg, err := orfs.LoadConfig(*config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Pool == "" {
+		cfg.Pool, cfg.MetadataPool = "test", "test_metadata"
+	}
+	if *pool != "" {
+		cfg.Pool = *pool
+	}
+	if *mdpool != "" {
+		cfg.MetadataPool = *mdpool
+	}
+	if *metricsAddr != "" {
+		cfg.MetricsAddr = *metricsAddr
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = 1000
+	}
+	if cfg.Logger == nil && cfg.LogLevel == "" {
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	fs, err := orfs.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure: %v\n", err)
+		os.Exit(1)
+	}
+	if err := fs.Connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		locks, err := fs.ListLocks()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list locks: %v\n", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "POOL\tOBJECT\tLOCK\tTYPE\tCLIENT\tCOOKIE\tADDR")
+		for _, l := range locks {
+			kind := "shared"
+			if l.Exclusive {
+				kind = "exclusive"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", l.Pool, l.Object, l.Name, kind, l.Client, l.Cookie, l.Addr)
+		}
+		w.Flush()
+	case args[0] == "break" && len(args) == 6:
+		err := fs.BreakLock(orfs.LockHolder{
+			Pool:   args[1],
+			Object: args[2],
+			Name:   args[3],
+			Client: args[4],
+			Cookie: args[5],
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to break lock: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+	fs.Close(context.Background())
+}
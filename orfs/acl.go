@@ -0,0 +1,353 @@
+package orfs
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/ceph/go-ceph/rados"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Names of the xattrs exposing the POSIX ACLs of an inode, the values use
+// the same binary format as Linux so FUSE can pass them through unchanged.
+const (
+	XattrACLAccess  = "system.posix_acl_access"
+	XattrACLDefault = "system.posix_acl_default"
+)
+
+// Tags of ACL entries, the values match <linux/posix_acl.h>.
+const (
+	ACLUserObj  = 0x01
+	ACLUser     = 0x02
+	ACLGroupObj = 0x04
+	ACLGroup    = 0x08
+	ACLMask     = 0x10
+	ACLOther    = 0x20
+)
+
+// Id of entries which don't refer to a specific user or group.
+const ACLUndefinedID = 0xffffffff
+
+const aclXattrVersion = 2
+
+// One entry of a POSIX.1e ACL.
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+// A POSIX.1e access or default ACL.
+type ACL []ACLEntry
+
+// Parses an ACL in the Linux xattr format, a little endian uint32 version
+// followed by tag, perm and id for each entry.
+func ParseACL(b []byte) (ACL, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclXattrVersion {
+		return nil, syscall.EINVAL
+	}
+	var acl ACL
+	for pos := 4; pos < len(b); pos += 8 {
+		acl = append(acl, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(b[pos:]),
+			Perm: binary.LittleEndian.Uint16(b[pos+2:]),
+			Id:   binary.LittleEndian.Uint32(b[pos+4:]),
+		})
+	}
+	return acl, acl.valid()
+}
+
+// Returns the ACL in the Linux xattr format.
+func (acl ACL) Bytes() []byte {
+	b := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i, e := range acl {
+		binary.LittleEndian.PutUint16(b[4+8*i:], e.Tag)
+		binary.LittleEndian.PutUint16(b[4+8*i+2:], e.Perm)
+		binary.LittleEndian.PutUint32(b[4+8*i+4:], e.Id)
+	}
+	return b
+}
+
+// valid checks that the ACL has exactly one of each of the owner, group and
+// other entries, no duplicate named entries and a mask if it has named
+// entries. The entries are sorted in the canonical order.
+func (acl ACL) valid() error {
+	counts := make(map[uint16]int)
+	ids := make(map[ACLEntry]bool)
+	for _, e := range acl {
+		if e.Perm&^7 != 0 {
+			return syscall.EINVAL
+		}
+		switch e.Tag {
+		case ACLUserObj, ACLGroupObj, ACLMask, ACLOther:
+		case ACLUser, ACLGroup:
+			key := ACLEntry{Tag: e.Tag, Id: e.Id}
+			if ids[key] {
+				return syscall.EINVAL
+			}
+			ids[key] = true
+		default:
+			return syscall.EINVAL
+		}
+		counts[e.Tag]++
+	}
+	if counts[ACLUserObj] != 1 || counts[ACLGroupObj] != 1 || counts[ACLOther] != 1 || counts[ACLMask] > 1 {
+		return syscall.EINVAL
+	}
+	if (counts[ACLUser] > 0 || counts[ACLGroup] > 0) && counts[ACLMask] == 0 {
+		return syscall.EINVAL
+	}
+	sort.SliceStable(acl, func(i, j int) bool {
+		if acl[i].Tag != acl[j].Tag {
+			return acl[i].Tag < acl[j].Tag
+		}
+		return acl[i].Id < acl[j].Id
+	})
+	return nil
+}
+
+// minimal reports whether the ACL is fully described by the mode bits.
+func (acl ACL) minimal() bool {
+	return len(acl) == 3
+}
+
+// groupTag is the entry the group bits of the mode correspond to, the mask
+// if there is one.
+func (acl ACL) groupTag() uint16 {
+	for _, e := range acl {
+		if e.Tag == ACLMask {
+			return ACLMask
+		}
+	}
+	return ACLGroupObj
+}
+
+// withMode returns a copy of the ACL with the owner, group (or mask) and
+// other entries taken from the permission bits of mode. The mode is
+// authoritative for these, like on Linux chmod changes the mask.
+func (acl ACL) withMode(mode os.FileMode) ACL {
+	perm := uint16(mode.Perm())
+	group := acl.groupTag()
+	ret := make(ACL, len(acl))
+	copy(ret, acl)
+	for i := range ret {
+		switch ret[i].Tag {
+		case ACLUserObj:
+			ret[i].Perm = perm >> 6 & 7
+		case ACLOther:
+			ret[i].Perm = perm & 7
+		case group:
+			ret[i].Perm = perm >> 3 & 7
+		}
+	}
+	return ret
+}
+
+// mode returns the permission bits described by the ACL.
+func (acl ACL) mode() os.FileMode {
+	var perm os.FileMode
+	group := acl.groupTag()
+	for _, e := range acl {
+		switch e.Tag {
+		case ACLUserObj:
+			perm |= os.FileMode(e.Perm) << 6
+		case ACLOther:
+			perm |= os.FileMode(e.Perm)
+		case group:
+			perm |= os.FileMode(e.Perm) << 3
+		}
+	}
+	return perm
+}
+
+// inherit returns the access ACL of a new inode created with mode in a
+// directory with this default ACL, the owner, group and other entries are
+// limited to the bits in mode.
+func (acl ACL) inherit(mode os.FileMode) ACL {
+	return acl.withMode(acl.mode() & mode)
+}
+
+// aclAccess evaluates the ACL for c as described in POSIX.1e, the owner
+// class is decided by the mode bits of obj.
+func (c *Caller) aclAccess(obj OrfsStat, acl ACL, want uint32) error {
+	acl = acl.withMode(obj.Mode())
+	mask := uint16(7)
+	for _, e := range acl {
+		if e.Tag == ACLMask {
+			mask = e.Perm
+		}
+	}
+	grant := func(perm uint16) error {
+		if uint32(perm)&want != want {
+			return os.ErrPermission
+		}
+		return nil
+	}
+
+	if c.Uid == obj.Uid() {
+		for _, e := range acl {
+			if e.Tag == ACLUserObj {
+				return grant(e.Perm)
+			}
+		}
+	}
+	for _, e := range acl {
+		if e.Tag == ACLUser && e.Id == c.Uid {
+			return grant(e.Perm & mask)
+		}
+	}
+	groupMatched := false
+	for _, e := range acl {
+		if (e.Tag == ACLGroupObj && c.inGroup(obj.Gid())) || (e.Tag == ACLGroup && c.inGroup(e.Id)) {
+			groupMatched = true
+			if grant(e.Perm&mask) == nil {
+				return nil
+			}
+		}
+	}
+	if groupMatched {
+		return os.ErrPermission
+	}
+	for _, e := range acl {
+		if e.Tag == ACLOther {
+			return grant(e.Perm)
+		}
+	}
+	return os.ErrPermission
+}
+
+// loadACLs reads the ACLs of the inode unless they are cached already.
+func (f *fsObj) loadACLs(ctx context.Context) error {
+	f.RLock()
+	loaded := f.aclLoaded
+	f.RUnlock()
+	if loaded {
+		return nil
+	}
+	var acls [2]ACL
+	for i, attr := range []string{XattrACLAccess, XattrACLDefault} {
+		buf := make([]byte, XattrSizeMax)
+		var n int
+		err := f.xattrCall(ctx, "rados.GetXattr", func(ioctx *rados.IOContext) (err error) {
+			n, err = ioctx.GetXattr(f.Inode().String(), xattrPrefix+attr, buf)
+			return err
+		})
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if acls[i], err = ParseACL(buf[:n]); err != nil {
+			return err
+		}
+	}
+	f.Lock()
+	f.acl, f.defaultACL, f.aclLoaded = acls[0], acls[1], true
+	f.Unlock()
+	return nil
+}
+
+// accessACL returns the access ACL of the inode, nil if it has none.
+func (f *fsObj) accessACL() (ACL, error) {
+	if err := f.loadACLs(context.Background()); err != nil {
+		return nil, err
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return f.acl, nil
+}
+
+// getDefaultACL returns the default ACL of the directory, nil if it has none.
+func (f *fsObj) getDefaultACL() (ACL, error) {
+	if err := f.loadACLs(context.Background()); err != nil {
+		return nil, err
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return f.defaultACL, nil
+}
+
+// setACLXattr stores one of the ACL xattrs. Setting the access ACL also sets
+// the permission bits, a minimal access ACL is only stored in the mode. The
+// caller holds the inode lock.
+func (f *fsObj) setACLXattr(ctx context.Context, ioctx *rados.IOContext, attr string, value []byte) error {
+	acl, err := ParseACL(value)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	f.aclLoaded = false
+	f.Unlock()
+	set := func(ioctx *rados.IOContext) error {
+		return ioctx.SetXattr(f.Inode().String(), xattrPrefix+attr, acl.Bytes())
+	}
+
+	if attr == XattrACLDefault {
+		if !f.IsDir() {
+			return syscall.EACCES
+		}
+		return f.xattrCall(ctx, "rados.SetXattr", set)
+	}
+
+	err = f.appendInode(ctx, ioctx, func() {
+		f.mode = f.mode&^os.ModePerm | acl.mode()
+	})
+	if err != nil {
+		return err
+	}
+	if acl.minimal() {
+		err := f.xattrCall(ctx, "rados.RmXattr", func(ioctx *rados.IOContext) error {
+			return ioctx.RmXattr(f.Inode().String(), xattrPrefix+attr)
+		})
+		if err == syscall.ENODATA {
+			return nil
+		}
+		return err
+	}
+	return f.xattrCall(ctx, "rados.SetXattr", set)
+}
+
+// getACLXattr returns the access ACL with the entries described by the mode
+// bits updated to the current mode.
+func (f *fsObj) getACLXattr(ctx context.Context, attr string) ([]byte, error) {
+	if err := f.loadACLs(ctx); err != nil {
+		return nil, err
+	}
+	f.RLock()
+	defer f.RUnlock()
+	acl := f.defaultACL
+	if attr == XattrACLAccess {
+		if f.acl == nil {
+			return nil, syscall.ENODATA
+		}
+		acl = f.acl.withMode(f.mode)
+	}
+	if acl == nil {
+		return nil, syscall.ENODATA
+	}
+	return acl.Bytes(), nil
+}
+
+// inheritACLs applies the default ACL of parent to a new inode, it returns
+// the mode of the new inode and the ACLs to store on it.
+func inheritACLs(parent OBJ, mode os.FileMode) (os.FileMode, ACL, ACL, error) {
+	p, ok := parent.(*fsObj)
+	if !ok {
+		return mode, nil, nil, nil
+	}
+	def, err := p.getDefaultACL()
+	if err != nil || def == nil {
+		return mode, nil, nil, err
+	}
+	acl := def.inherit(mode.Perm())
+	mode = mode&^os.ModePerm | acl.mode()
+	if acl.minimal() {
+		acl = nil
+	}
+	if !mode.IsDir() {
+		def = nil
+	}
+	return mode, acl, def, nil
+}
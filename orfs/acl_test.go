@@ -0,0 +1,121 @@
+package orfs
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	minimal := ACL{{ACLUserObj, 6, ACLUndefinedID}, {ACLGroupObj, 4, ACLUndefinedID}, {ACLOther, 4, ACLUndefinedID}}
+	named := ACL{
+		{ACLUserObj, 7, ACLUndefinedID},
+		{ACLUser, 5, 1000},
+		{ACLGroupObj, 5, ACLUndefinedID},
+		{ACLGroup, 7, 100},
+		{ACLMask, 7, ACLUndefinedID},
+		{ACLOther, 0, ACLUndefinedID},
+	}
+	// Named entries given out of order are sorted.
+	unsorted := ACL{named[5], named[3], named[0], named[4], named[2], named[1]}
+
+	tests := []struct {
+		name string
+		in   []byte
+		want ACL
+		err  error
+	}{
+		{"minimal", minimal.Bytes(), minimal, nil},
+		{"named", named.Bytes(), named, nil},
+		{"unsorted", unsorted.Bytes(), named, nil},
+		{"empty", nil, nil, syscall.EINVAL},
+		{"torn", minimal.Bytes()[:10], nil, syscall.EINVAL},
+		{"version", append([]byte{1, 0, 0, 0}, minimal.Bytes()[4:]...), nil, syscall.EINVAL},
+		{"no other", minimal[:2].Bytes(), nil, syscall.EINVAL},
+		{"two owners", append(ACL{minimal[0]}, minimal...).Bytes(), nil, syscall.EINVAL},
+		{"no mask", ACL{minimal[0], named[1], minimal[1], minimal[2]}.Bytes(), nil, syscall.EINVAL},
+		{"duplicate user", append(ACL{named[1]}, named...).Bytes(), nil, syscall.EINVAL},
+		{"bad perm", ACL{{ACLUserObj, 8, ACLUndefinedID}, minimal[1], minimal[2]}.Bytes(), nil, syscall.EINVAL},
+		{"bad tag", ACL{minimal[0], {0x40, 0, 0}, minimal[1], minimal[2]}.Bytes(), nil, syscall.EINVAL},
+	}
+	for _, test := range tests {
+		acl, err := ParseACL(test.in)
+		if err != test.err {
+			t.Errorf("%v: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(acl, test.want) {
+			t.Errorf("%v: parsed %v, want %v", test.name, acl, test.want)
+		}
+	}
+}
+
+func TestACLInherit(t *testing.T) {
+	def := ACL{
+		{ACLUserObj, 7, ACLUndefinedID},
+		{ACLUser, 7, 1000},
+		{ACLGroupObj, 5, ACLUndefinedID},
+		{ACLMask, 7, ACLUndefinedID},
+		{ACLOther, 5, ACLUndefinedID},
+	}
+	tests := []struct {
+		mode os.FileMode
+		want os.FileMode
+		mask uint16
+	}{
+		{0777, 0775, 7},
+		{0644, 0644, 4},
+		{0600, 0600, 0},
+	}
+	for _, test := range tests {
+		acl := def.inherit(test.mode)
+		if acl.mode() != test.want {
+			t.Errorf("inherit(%o): mode %o, want %o", test.mode, acl.mode(), test.want)
+		}
+		// The group bits limit the mask, not the owning group entry.
+		if acl[3].Perm != test.mask || acl[2].Perm != 5 || acl[1].Perm != 7 {
+			t.Errorf("inherit(%o): entries %v", test.mode, acl)
+		}
+	}
+	if def[3].Perm != 7 {
+		t.Error("inherit changed the default ACL")
+	}
+}
+
+func TestACLAccess(t *testing.T) {
+	acl := ACL{
+		{ACLUserObj, 7, ACLUndefinedID},
+		{ACLUser, 7, 1000},
+		{ACLUser, 4, 1001},
+		{ACLGroupObj, 0, ACLUndefinedID},
+		{ACLGroup, 6, 100},
+		{ACLMask, 5, ACLUndefinedID},
+		{ACLOther, 4, ACLUndefinedID},
+	}
+	// The mode is authoritative for owner, mask and other.
+	obj := &Istat{mode: 0754, uid: 0, gid: 50}
+
+	tests := []struct {
+		name   string
+		caller Caller
+		want   uint32
+		err    error
+	}{
+		{"owner", Caller{Uid: 0, Gid: 1}, 7, nil},
+		{"named user", Caller{Uid: 1000, Gid: 1}, 5, nil},
+		{"named user masked", Caller{Uid: 1000, Gid: 1}, 2, os.ErrPermission},
+		{"named user read", Caller{Uid: 1001, Gid: 1}, 4, nil},
+		{"named user not owner", Caller{Uid: 1001, Gid: 1}, 1, os.ErrPermission},
+		{"owning group doesn't fall back to other", Caller{Uid: 2000, Gid: 50}, 4, os.ErrPermission},
+		{"named group", Caller{Uid: 2000, Gid: 1, Groups: []uint32{100}}, 4, nil},
+		{"named group masked", Caller{Uid: 2000, Gid: 1, Groups: []uint32{100}}, 2, os.ErrPermission},
+		{"other", Caller{Uid: 2000, Gid: 1}, 4, nil},
+		{"other write", Caller{Uid: 2000, Gid: 1}, 2, os.ErrPermission},
+	}
+	for _, test := range tests {
+		if err := test.caller.aclAccess(obj, acl, test.want); err != test.err {
+			t.Errorf("%v: error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
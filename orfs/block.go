@@ -0,0 +1,248 @@
+package orfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/ceph/go-ceph/rados"
+	"io"
+	"os"
+	"time"
+)
+
+// File data is striped over objects of the stripe size, BLOCKSIZE unless
+// configured otherwise, named <inode>.<n+1> for block n, so files written
+// before striping existed keep their data in block 0. A missing object or the part of a block past
+// the end of its object is a hole and reads as zeros up to the file size.
+
+func (f *fsObj) blockSize() int64 {
+	return f.fs.cfg.StripeSize
+}
+
+// Returns the name of the object holding block n of the file.
+func (f *fsObj) blockName(n int64) string {
+	return fmt.Sprintf("%v.%v", f.Inode().String(), n+1)
+}
+
+// readBlocks reads len(p) bytes at off. Holes inside the file size read as
+// zeros, past the size data is returned as long as the objects have it.
+func (f *fsObj) readBlocks(ctx context.Context, p []byte, off int64) (int, error) {
+	f.RLock()
+	size := f.size
+	f.RUnlock()
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		blockOff := pos % f.blockSize()
+		want := len(p) - read
+		if int64(want) > f.blockSize()-blockOff {
+			want = int(f.blockSize() - blockOff)
+		}
+		oid := f.blockName(pos / f.blockSize())
+		_, span := f.radosSpan(ctx, "rados.Read", oid, false)
+		var n int
+		err := f.fs.retry(ctx, false, func(ioctx *rados.IOContext) (err error) {
+			n, err = ioctx.Read(oid, p[read:read+want], uint64(blockOff))
+			return err
+		})
+		if err == rados.RadosErrorNotFound {
+			endSpan(span, nil)
+		} else {
+			endSpan(span, err)
+		}
+		if err == rados.RadosErrorNotFound {
+			n = 0
+		} else if err != nil {
+			return read, err
+		}
+		f.fs.metrics.transferred(false, "read", n)
+		read += n
+		if n < want {
+			// Short read, either a hole or the end of the file.
+			end := pos - blockOff + f.blockSize()
+			if end > size {
+				end = size
+			}
+			if off+int64(read) >= end {
+				break
+			}
+			hole := int(end - off - int64(read))
+			if hole > len(p)-read {
+				hole = len(p) - read
+			}
+			for i := read; i < read+hole; i++ {
+				p[i] = 0
+			}
+			read += hole
+		}
+	}
+	if read == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return read, nil
+}
+
+// writeBlocks writes p at off, grows the in memory size and updates the
+// modification time. They are recorded in the inode by commit.
+func (f *fsObj) writeBlocks(ctx context.Context, p []byte, off int64) (int, error) {
+	written := 0
+	for written < len(p) {
+		pos := off + int64(written)
+		blockOff := pos % f.blockSize()
+		n := len(p) - written
+		if int64(n) > f.blockSize()-blockOff {
+			n = int(f.blockSize() - blockOff)
+		}
+		oid := f.blockName(pos / f.blockSize())
+		_, span := f.radosSpan(ctx, "rados.Write", oid, false)
+		// Writing at an offset is idempotent, it can be retried.
+		err := f.fs.retry(ctx, false, func(ioctx *rados.IOContext) error {
+			return ioctx.Write(oid, p[written:written+n], uint64(blockOff))
+		})
+		endSpan(span, err)
+		if err != nil {
+			// If error, assume nothing was written. Ceph should be fully
+			// consistent and if write fails without info on how much was
+			// written, we have to assume it was aborted.
+			return written, err
+		}
+		f.fs.metrics.transferred(false, "write", n)
+		written += n
+		f.Lock()
+		if pos+int64(n) > f.size {
+			f.size = pos + int64(n)
+		}
+		f.modTime = time.Now()
+		f.dirty = true
+		f.Unlock()
+	}
+	return written, nil
+}
+
+// lastBlock returns the index of the last block which may exist. The size
+// isn't always persisted, so blocks past it are probed until one is missing.
+func (f *fsObj) lastBlock(ctx context.Context) (int64, error) {
+	f.RLock()
+	last := (f.size - 1) / f.blockSize()
+	f.RUnlock()
+	for {
+		oid := f.blockName(last + 1)
+		_, span := f.radosSpan(ctx, "rados.Stat", oid, false)
+		err := f.fs.retry(ctx, false, func(ioctx *rados.IOContext) error {
+			_, err := ioctx.Stat(oid)
+			return err
+		})
+		endSpan(span, err)
+		if err == rados.RadosErrorNotFound {
+			return last, nil
+		} else if err != nil {
+			return last, err
+		}
+		last++
+	}
+}
+
+// deleteBlocks deletes block from and all blocks after it.
+func (f *fsObj) deleteBlocks(ctx context.Context, from int64) error {
+	last, err := f.lastBlock(ctx)
+	if err != nil {
+		return err
+	}
+	for n := last; n >= from; n-- {
+		// A retried delete may find the block gone.
+		oid := f.blockName(n)
+		_, span := f.radosSpan(ctx, "rados.Delete", oid, false)
+		err := f.fs.retry(ctx, false, func(ioctx *rados.IOContext) error {
+			return ioctx.Delete(oid)
+		})
+		endSpan(span, err)
+		if err != nil && err != rados.RadosErrorNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate changes the size of the file. Shrinking trims the tail block and
+// deletes the blocks wholly past the new end, growing leaves a hole.
+func (f *fsObj) Truncate(size int64) error {
+	return f.truncate(context.Background(), size)
+}
+
+// truncateContext is Truncate with a context.
+func truncateContext(ctx context.Context, obj OBJ, size int64) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.truncate(ctx, size)
+	}
+	return obj.Truncate(size)
+}
+
+func (f *fsObj) truncate(ctx context.Context, size int64) error {
+	if f.IsDir() {
+		return os.ErrInvalid
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.fs.logger.Debug("Truncate", "inode", f.Inode(), "size", size)
+
+	tail := size / f.blockSize()
+	if size%f.blockSize() != 0 {
+		oid := f.blockName(tail)
+		_, span := f.radosSpan(ctx, "rados.Truncate", oid, false)
+		err := f.fs.retry(ctx, false, func(ioctx *rados.IOContext) error {
+			return ioctx.Truncate(oid, uint64(size%f.blockSize()))
+		})
+		endSpan(span, err)
+		if err != nil && err != rados.RadosErrorNotFound {
+			return err
+		}
+		tail++
+	}
+	if err := f.deleteBlocks(ctx, tail); err != nil {
+		return err
+	}
+	return f.modifyInode(ctx, func() {
+		f.size = size
+		f.modTime = time.Now()
+	})
+}
+
+// appendBlocks writes p at the end of the file and returns the new end. The
+// inode stays locked from reading the size until the new size is recorded,
+// so appends from several handles or clients never overlap.
+func (f *fsObj) appendBlocks(ctx context.Context, p []byte) (int64, int, error) {
+	var off int64
+	var written int
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		f.RLock()
+		off = f.size
+		f.RUnlock()
+		var err error
+		written, err = f.writeBlocks(ctx, p, off)
+		if written == 0 {
+			return err
+		}
+		aerr := f.appendInode(ctx, ioctx, func() {
+			f.modTime = time.Now()
+		})
+		if err == nil {
+			err = aerr
+		}
+		return err
+	})
+	return off + int64(written), written, err
+}
+
+// commit records the size and modification time changed by writes in the
+// inode. It reports false if there were no such changes.
+func (f *fsObj) commit(ctx context.Context) (bool, error) {
+	f.RLock()
+	dirty := f.dirty
+	f.RUnlock()
+	if !dirty {
+		return false, nil
+	}
+	f.fs.logger.Debug("Commit", "inode", f.Inode(), "size", f.Size())
+	return true, f.modifyInode(ctx, func() {})
+}
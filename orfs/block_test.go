@@ -0,0 +1,45 @@
+package orfs
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"os"
+	"testing"
+)
+
+func TestBlockName(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	inode := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	f := &fsObj{inode: inode, fs: fs}
+	// Block 0 keeps the name data had before striping.
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, inode.String() + ".1"},
+		{1, inode.String() + ".2"},
+		{41, inode.String() + ".42"},
+	}
+	for _, test := range tests {
+		if got := f.blockName(test.n); got != test.want {
+			t.Errorf("blockName(%v) = %v, want %v", test.n, got, test.want)
+		}
+	}
+}
+
+func TestTruncateInvalid(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	tests := []struct {
+		name string
+		obj  *fsObj
+		size int64
+	}{
+		{"negative", &fsObj{inode: uuid.New(), fs: fs, size: 10}, -1},
+		{"directory", &fsObj{inode: uuid.New(), fs: fs, isDir: true, mode: os.ModeDir | 0755}, 0},
+	}
+	for _, test := range tests {
+		if err := test.obj.truncate(context.Background(), test.size); err != os.ErrInvalid {
+			t.Errorf("%v: error %v, want %v", test.name, err, os.ErrInvalid)
+		}
+	}
+}
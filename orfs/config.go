@@ -0,0 +1,146 @@
+package orfs
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures an Orfs, zero fields take the defaults. In YAML the keys
+// are the yaml names of the fields, in the environment they are upper case
+// with an ORFS_ prefix, ORFS_POOL, ORFS_OP_TIMEOUT and so on. Durations are
+// written like 30s.
+type Config struct {
+	// Data pool and metadata pool, the metadata pool defaults to the data
+	// pool. An erasure coded pool can't hold metadata.
+	Pool         string `yaml:"pool"`
+	MetadataPool string `yaml:"metadata_pool"`
+	// RADOS namespace in both pools, the default namespace if empty.
+	Namespace string `yaml:"namespace"`
+
+	// Ceph cluster and user, like the --cluster and --id options of the
+	// ceph tools, default ceph and admin.
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+	// Path of ceph.conf and of the keyring, librados searches its default
+	// locations for those left empty.
+	CephConfig string `yaml:"ceph_config"`
+	Keyring    string `yaml:"keyring"`
+	// Timeout of operations on OSDs and monitors, zero waits forever.
+	OpTimeout time.Duration `yaml:"op_timeout"`
+
+	// Number of inodes kept in memory, default DefaultCacheSize.
+	CacheSize int `yaml:"cache_size"`
+	// Blocks read ahead of sequential reads, default 2, -1 turns read-ahead
+	// off.
+	ReadAheadBlocks int `yaml:"read_ahead_blocks"`
+	// Size of the objects file data is striped over, default BLOCKSIZE. All
+	// clients of a filesystem have to use the same stripe size, files
+	// written with another one read wrong.
+	StripeSize int64 `yaml:"stripe_size"`
+
+	// Level of the logs written to stderr, debug, info, warn or error. No
+	// logs are written if it is empty and Logger is nil.
+	LogLevel string `yaml:"log_level"`
+	// Logger, takes precedence over LogLevel.
+	Logger *slog.Logger `yaml:"-"`
+
+	// Address to serve the metrics on at /metrics from Connect to Close,
+	// like :9100. Setting it enables the metrics, see EnableMetrics.
+	MetricsAddr string `yaml:"metrics_addr"`
+}
+
+// Default number of inodes kept in memory.
+const DefaultCacheSize = 100000
+
+// LoadConfig reads the YAML file path, if path isn't empty, and then the
+// ORFS_ environment variables, which take precedence over the file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return cfg, cfg.readEnv()
+}
+
+// readEnv sets the fields which have a variable in the environment.
+func (cfg *Config) readEnv() error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := "ORFS_" + strings.ToUpper(tag)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		var err error
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+		case time.Duration:
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			field.SetInt(int64(d))
+		default:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 64)
+			field.SetInt(n)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// withDefaults returns cfg with the defaults filled in, or an error if cfg
+// is invalid.
+func (cfg Config) withDefaults() (Config, error) {
+	if cfg.Pool == "" {
+		return cfg, fmt.Errorf("no pool configured")
+	}
+	if cfg.MetadataPool == "" {
+		cfg.MetadataPool = cfg.Pool
+	}
+	if cfg.Cluster == "" {
+		cfg.Cluster = "ceph"
+	}
+	if cfg.User == "" {
+		cfg.User = "admin"
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.ReadAheadBlocks == 0 {
+		cfg.ReadAheadBlocks = defaultReadAheadBlocks
+	}
+	if cfg.StripeSize == 0 {
+		cfg.StripeSize = BLOCKSIZE
+	}
+	if cfg.CacheSize < 0 || cfg.StripeSize < 0 || cfg.OpTimeout < 0 {
+		return cfg, fmt.Errorf("negative cache size, stripe size or timeout")
+	}
+	if cfg.Logger == nil && cfg.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return cfg, err
+		}
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	}
+	return cfg, nil
+}
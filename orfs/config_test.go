@@ -0,0 +1,53 @@
+package orfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orfs.yaml")
+	yaml := "pool: data\nnamespace: ns\nop_timeout: 30s\ncache_size: 10\n"
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ORFS_CACHE_SIZE", "20")
+	t.Setenv("ORFS_USER", "orfs")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Pool != "data" || cfg.Namespace != "ns" || cfg.OpTimeout != 30*time.Second {
+		t.Fatalf("YAML not loaded: %+v", cfg)
+	}
+	if cfg.CacheSize != 20 || cfg.User != "orfs" {
+		t.Fatalf("Environment doesn't take precedence: %+v", cfg)
+	}
+
+	cfg, err = cfg.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults: %v", err)
+	}
+	if cfg.MetadataPool != "data" || cfg.Cluster != "ceph" || cfg.StripeSize != BLOCKSIZE {
+		t.Fatalf("Defaults not set: %+v", cfg)
+	}
+
+	t.Setenv("ORFS_OP_TIMEOUT", "soon")
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("Invalid duration accepted")
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Pool: "a", CacheSize: -1},
+		{Pool: "a", LogLevel: "loud"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) didn't fail", cfg)
+		}
+	}
+}
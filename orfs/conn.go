@@ -0,0 +1,333 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/google/uuid"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// librados recovers from lost monitor and OSD sessions by itself, but a
+// client the cluster has blocklisted, after it missed its heartbeats for
+// example, fails every call until it connects again as a new client. Calls
+// which can be repeated go through retry, which reconnects and tries them
+// again. Other calls go through call and fail, the connection is then
+// replaced in the background so the next calls succeed. A new client doesn't
+// hold the watches and leases of the old one, they are dropped and taken
+// again when needed. The old connection is shut down once nothing uses it.
+
+// cluster is a connection and the IO contexts of both pools on it.
+type cluster struct {
+	conn  *rados.Conn
+	ioctx *rados.IOContext
+	mdctx *rados.IOContext
+	// Calls, locks and watches using the connection. A replaced connection
+	// is shut down once they are done.
+	users sync.WaitGroup
+}
+
+func (c *cluster) shutdown() {
+	if c.ioctx != nil {
+		c.ioctx.Destroy()
+	}
+	if c.mdctx != nil {
+		c.mdctx.Destroy()
+	}
+	c.conn.Shutdown()
+}
+
+// Number of attempts of a call which fails with a transient error, and the
+// bounds of the backoff between them and between attempts to reconnect.
+const (
+	retryAttempts   = 5
+	retryBackoffMin = 100 * time.Millisecond
+	retryBackoffMax = 10 * time.Second
+)
+
+// How long to try to reconnect when the context has no deadline.
+const reconnectWait = 2 * time.Minute
+
+var (
+	errTimedOut = rados.RadosError(-int(syscall.ETIMEDOUT))
+	errShutdown = rados.RadosError(-int(syscall.ESHUTDOWN))
+	errNotConn  = rados.RadosError(-int(syscall.ENOTCONN))
+)
+
+// connLost reports whether err means the client has to connect again,
+// librados returns ESHUTDOWN once the client is blocklisted.
+func connLost(err error) bool {
+	return err == errShutdown || err == errNotConn
+}
+
+// transient reports whether a call which failed with err may succeed when
+// it is repeated.
+func transient(err error) bool {
+	return connLost(err) || err == errTimedOut
+}
+
+// dial connects to the cluster and opens the IO contexts of both pools.
+func (fs *Orfs) dial() (_ *cluster, err error) {
+	cfg := fs.cfg
+	conn, err := rados.NewConnWithClusterAndUser(cfg.Cluster, "client."+cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{conn: conn}
+	defer func() {
+		if err != nil {
+			c.shutdown()
+		}
+	}()
+	if cfg.CephConfig != "" {
+		err = conn.ReadConfigFile(cfg.CephConfig)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	options := map[string]string{}
+	if cfg.Keyring != "" {
+		options["keyring"] = cfg.Keyring
+	}
+	if cfg.OpTimeout > 0 {
+		secs := strconv.FormatFloat(cfg.OpTimeout.Seconds(), 'f', -1, 64)
+		options["rados_osd_op_timeout"] = secs
+		options["rados_mon_op_timeout"] = secs
+		options["client_mount_timeout"] = secs
+	}
+	for option, value := range options {
+		if err := conn.SetConfigOption(option, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Connect(); err != nil {
+		return nil, err
+	}
+	fs.logger.Debug("Connected, opening IO contexts")
+	if c.ioctx, err = conn.OpenIOContext(fs.pool); err != nil {
+		return nil, err
+	}
+	c.ioctx.SetNamespace(cfg.Namespace)
+	if c.mdctx, err = conn.OpenIOContext(fs.mdpool); err != nil {
+		return nil, err
+	}
+	c.mdctx.SetNamespace(cfg.Namespace)
+	return c, nil
+}
+
+// connection returns the IO context of the metadata pool if md is set or
+// else of the data pool, and the generation of the connection it is on. The
+// connection isn't shut down before release is called.
+func (fs *Orfs) connection(md bool) (_ *rados.IOContext, gen uint64, release func(), _ error) {
+	fs.connMu.RLock()
+	defer fs.connMu.RUnlock()
+	if fs.closed {
+		return nil, 0, nil, os.ErrClosed
+	}
+	c := fs.cluster
+	if c == nil {
+		return nil, 0, nil, syscall.ENOTCONN
+	}
+	c.users.Add(1)
+	if md {
+		return c.mdctx, fs.connGen, c.users.Done, nil
+	}
+	return c.ioctx, fs.connGen, c.users.Done, nil
+}
+
+// call runs call once on the IO context of the data pool or, if md is set,
+// of the metadata pool. It returns os.ErrClosed after Close.
+func (fs *Orfs) call(md bool, call func(ioctx *rados.IOContext) error) error {
+	ioctx, _, release, err := fs.connection(md)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return call(ioctx)
+}
+
+// retry runs call, which has to be safe to repeat, on the IO context of the
+// data pool or, if md is set, of the metadata pool. call is repeated after
+// transient errors, on a new connection if the connection was lost, up to
+// retryAttempts times or until ctx is done.
+func (fs *Orfs) retry(ctx context.Context, md bool, call func(ioctx *rados.IOContext) error) error {
+	backoff := retryBackoffMin
+	for attempt := 1; ; attempt++ {
+		ioctx, gen, release, err := fs.connection(md)
+		if err != nil {
+			return err
+		}
+		err = call(ioctx)
+		release()
+		if err == nil || !transient(err) || attempt == retryAttempts {
+			return err
+		}
+		fs.logger.Info("Retrying RADOS call", "attempt", attempt, "error", err)
+		if connLost(err) {
+			if err := fs.reconnect(ctx, gen); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sleepBackoff(ctx, &backoff); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepBackoff waits for about backoff, which it doubles up to
+// retryBackoffMax, or until ctx is done.
+func sleepBackoff(ctx context.Context, backoff *time.Duration) error {
+	sleep := *backoff/2 + time.Duration(rand.Int63n(int64(*backoff)))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(sleep):
+	}
+	if *backoff *= 2; *backoff > retryBackoffMax {
+		*backoff = retryBackoffMax
+	}
+	return nil
+}
+
+// reconnect replaces the connection of generation gen, it returns at once
+// if it was replaced already. It keeps trying until ctx is done, or for
+// reconnectWait if ctx has no deadline.
+func (fs *Orfs) reconnect(ctx context.Context, gen uint64) (err error) {
+	fs.reconnectMu.Lock()
+	fs.connMu.RLock()
+	current, closed := fs.connGen, fs.closed
+	fs.connMu.RUnlock()
+	if closed || current != gen {
+		fs.reconnectMu.Unlock()
+		if closed {
+			return os.ErrClosed
+		}
+		return nil
+	}
+
+	ctx, end := fs.startOp(ctx, "Reconnect")
+	defer end(&err)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reconnectWait)
+		defer cancel()
+	}
+	backoff := retryBackoffMin
+	var c *cluster
+	for {
+		if c, err = fs.dial(); err == nil {
+			break
+		}
+		fs.logger.Warn("Reconnect failed", "error", err)
+		if err := sleepBackoff(ctx, &backoff); err != nil {
+			fs.reconnectMu.Unlock()
+			return err
+		}
+	}
+	fs.connMu.Lock()
+	old := fs.cluster
+	fs.cluster = c
+	fs.connGen++
+	fs.connMu.Unlock()
+	if old != nil {
+		// Calls may still run on the old connection.
+		go func() {
+			old.users.Wait()
+			old.shutdown()
+		}()
+	}
+	fs.watchMu.Lock()
+	watches := fs.watches
+	fs.watches = make(map[uuid.UUID]*inodeWatch)
+	fs.watchMu.Unlock()
+	fs.reconnectMu.Unlock()
+
+	// Releasing the leases flushes write buffers, which may reconnect
+	// again.
+	for inode, w := range watches {
+		w.stop()
+		fs.invalidate(inode)
+		fs.revokeLeases(inode)
+	}
+	return nil
+}
+
+// Close flushes and closes the Files which are still open, which releases
+// their leases, stops watching inodes and disconnects once the calls still
+// running are done. If ctx is done before that Close returns and the
+// connection is shut down later. Nothing may use the Orfs, its OBJs or Files
+// while or after it is closed.
+func (fs *Orfs) Close(ctx context.Context) (err error) {
+	ctx, end := fs.startOp(ctx, "Close")
+	defer end(&err)
+	// Read-ahead and timer flushes stop at their next call.
+	fs.stopBg()
+	if fs.metricsServer != nil {
+		fs.metricsServer.Close()
+	}
+	fs.filesMu.Lock()
+	files := make([]*File, 0, len(fs.files))
+	for f := range fs.files {
+		files = append(files, f)
+	}
+	fs.filesMu.Unlock()
+	for _, f := range files {
+		if cerr := f.CloseContext(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	fs.reconnectMu.Lock()
+	defer fs.reconnectMu.Unlock()
+	fs.watchMu.Lock()
+	watches := fs.watches
+	fs.watches = make(map[uuid.UUID]*inodeWatch)
+	fs.watchMu.Unlock()
+	for _, w := range watches {
+		w.stop()
+	}
+
+	fs.connMu.Lock()
+	c := fs.cluster
+	fs.cluster = nil
+	fs.closed = true
+	fs.connMu.Unlock()
+	if c == nil {
+		return err
+	}
+	// No new calls start now, wait for the running ones like reconnect.
+	drained := make(chan struct{})
+	go func() {
+		c.users.Wait()
+		c.shutdown()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// registerFile records f as open, Close closes it if it's still open then.
+func (fs *Orfs) registerFile(f *File) {
+	fs.filesMu.Lock()
+	fs.files[f] = struct{}{}
+	fs.filesMu.Unlock()
+}
+
+func (fs *Orfs) unregisterFile(f *File) {
+	fs.filesMu.Lock()
+	delete(fs.files, f)
+	fs.filesMu.Unlock()
+}
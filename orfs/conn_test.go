@@ -0,0 +1,84 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	fs.cluster = &cluster{}
+	calls := 0
+	err := fs.retry(context.Background(), false, func(*rados.IOContext) error {
+		if calls++; calls < 3 {
+			return errTimedOut
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("Timeouts not retried, %v calls: %v", calls, err)
+	}
+
+	calls = 0
+	err = fs.retry(context.Background(), false, func(*rados.IOContext) error {
+		calls++
+		return rados.RadosErrorNotFound
+	})
+	if err != rados.RadosErrorNotFound || calls != 1 {
+		t.Fatalf("Permanent error retried, %v calls: %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = fs.retry(ctx, false, func(*rados.IOContext) error {
+		return errTimedOut
+	})
+	if err != context.Canceled {
+		t.Fatalf("Retry went on after the context was done: %v", err)
+	}
+}
+
+func TestCloseUnconnected(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	if err := fs.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	err := fs.retry(context.Background(), false, func(*rados.IOContext) error {
+		t.Fatal("Call made after Close")
+		return nil
+	})
+	if err != os.ErrClosed {
+		t.Fatalf("Call after Close returned %v", err)
+	}
+	err = fs.call(true, func(*rados.IOContext) error {
+		t.Fatal("Call made after Close")
+		return nil
+	})
+	if err != os.ErrClosed {
+		t.Fatalf("Single call after Close returned %v", err)
+	}
+	if err := fs.reconnect(context.Background(), 0); err != os.ErrClosed {
+		t.Fatalf("Reconnect after Close returned %v", err)
+	}
+}
+
+func TestCloseWaitsForCalls(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	fs.cluster = &cluster{conn: new(rados.Conn)}
+	running, done := make(chan struct{}), make(chan struct{})
+	go fs.call(false, func(*rados.IOContext) error {
+		close(running)
+		<-done
+		return nil
+	})
+	<-running
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := fs.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Close with a call running returned %v", err)
+	}
+	close(done)
+}
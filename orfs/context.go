@@ -0,0 +1,27 @@
+package orfs
+
+import (
+	"context"
+)
+
+// The *Context variants of the Orfs methods take the Caller from the
+// context and check it for cancellation between the RADOS operations they
+// issue, a RADOS operation which has been sent is not aborted. Operations
+// which change more than one object, like Rename, check it before they
+// start changing anything.
+
+type callerKey struct{}
+
+// Returns a copy of ctx carrying c as the identity operations are performed
+// as. Permission checks, audit logging and quotas use it.
+func WithCaller(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// Returns the Caller carried by ctx, Superuser if there is none.
+func CallerFromContext(ctx context.Context) *Caller {
+	if c, ok := ctx.Value(callerKey{}).(*Caller); ok && c != nil {
+		return c
+	}
+	return Superuser
+}
@@ -0,0 +1,166 @@
+package orfs
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Number of block sized RADOS operations ReadFrom and WriteTo keep in
+// flight.
+const copyPipelineDepth = 4
+
+// The RADOS bindings don't expose a server side copy, so copies between two
+// ORFS files go through the client as well, but io.Copy picks these fast
+// paths and they move whole, aligned blocks with several operations in
+// flight.
+
+// ReadFrom writes everything read from r at the file position, implementing
+// io.ReaderFrom. Data is written in block aligned chunks of up to a block
+// while the next chunk is read from r.
+func (f *File) ReadFrom(r io.Reader) (_ int64, err error) {
+	defer pathError("write", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(context.Background(), "ReadFrom", slog.Any("inode", f.Inode.Inode()))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.writable() {
+		return 0, syscall.EBADF
+	}
+	if f.flag&os.O_APPEND != 0 {
+		// Appends have to be written one at a time at the end of file.
+		return io.Copy(struct{ io.Writer }{f}, r)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return 0, err
+	}
+	f.ra.invalidate()
+	f.holdWriteLease(ctx)
+	defer f.holdWriteLease(ctx)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	slots := make(chan struct{}, copyPipelineDepth)
+	start := f.pos
+	// Offset of the first failed write, everything before it was written.
+	failedAt := int64(-1)
+	var writeErr error
+
+	pos := start
+	var readErr error
+	for {
+		mu.Lock()
+		failed := failedAt >= 0
+		mu.Unlock()
+		if failed {
+			break
+		}
+		buf := make([]byte, f.Inode.blockSize()-pos%f.Inode.blockSize())
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(p []byte, off int64) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				written, err := f.Inode.writeBlocks(ctx, p, off)
+				if err != nil {
+					mu.Lock()
+					if failedAt < 0 || off+int64(written) < failedAt {
+						failedAt = off + int64(written)
+						writeErr = err
+					}
+					mu.Unlock()
+				}
+			}(buf[:n], pos)
+			pos += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			readErr = err
+			break
+		}
+	}
+	wg.Wait()
+
+	if failedAt >= 0 {
+		f.pos = failedAt
+		return failedAt - start, writeErr
+	}
+	f.pos = pos
+	return pos - start, readErr
+}
+
+// WriteTo writes the file from the file position to w, implementing
+// io.WriterTo. The next blocks are read while the current one is written.
+func (f *File) WriteTo(w io.Writer) (_ int64, err error) {
+	defer pathError("read", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(context.Background(), "WriteTo", slog.Any("inode", f.Inode.Inode()))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.readable() {
+		return 0, syscall.EBADF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return 0, err
+	}
+	f.ra.invalidate()
+
+	type chunk struct {
+		data []byte
+		err  error
+		full bool
+	}
+	// Chunks are read in order, each one gets a channel which the writer
+	// waits on, so writes to w stay in order.
+	chunks := make(chan chan chunk, copyPipelineDepth)
+	done := make(chan struct{})
+	go func(pos int64) {
+		defer close(chunks)
+		for {
+			result := make(chan chunk, 1)
+			select {
+			case chunks <- result:
+			case <-done:
+				return
+			}
+			buf := make([]byte, f.Inode.blockSize()-pos%f.Inode.blockSize())
+			go func(off int64) {
+				n, err := f.Inode.readBlocks(ctx, buf, off)
+				result <- chunk{data: buf[:n], err: err, full: n == len(buf)}
+			}(pos)
+			pos += int64(len(buf))
+		}
+	}(f.pos)
+	defer close(done)
+
+	var total int64
+	for result := range chunks {
+		c := <-result
+		if len(c.data) > 0 {
+			n, err := w.Write(c.data)
+			total += int64(n)
+			f.pos += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+		if c.err == io.EOF || (c.err == nil && !c.full) {
+			return total, nil
+		} else if c.err != nil {
+			return total, c.err
+		}
+	}
+	return total, nil
+}
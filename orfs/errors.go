@@ -0,0 +1,89 @@
+package orfs
+
+import (
+	"errors"
+	"github.com/ceph/go-ceph/rados"
+	"io"
+	"os"
+	"syscall"
+)
+
+// The methods of Orfs and File return a *os.PathError, or a *os.LinkError
+// for those taking two names, with the operation and the name it failed on,
+// like package os. The error wrapped in it is one of the errors of package
+// os, such as os.ErrNotExist, a syscall.Errno such as syscall.ENOTEMPTY, an
+// error of this package or the error of the context. Errors of RADOS are
+// turned into the matching errno, so errors.Is works on all of them:
+//
+//	if errors.Is(err, os.ErrNotExist) {
+//		// ENOENT
+//	}
+//
+// Reads at the end of a file return a bare io.EOF.
+
+// ErrCorruptMetadata is returned for an inode, directory entry or journal
+// entry in RADOS which can't be parsed.
+var ErrCorruptMetadata = errors.New("orfs: corrupt metadata")
+
+// corruptError is an error about unparsable metadata, it is
+// ErrCorruptMetadata to errors.Is.
+type corruptError string
+
+func (e corruptError) Error() string {
+	return string(e)
+}
+
+func (e corruptError) Is(target error) bool {
+	return target == ErrCorruptMetadata
+}
+
+// mapError turns a RADOS error into the error describing it.
+func mapError(err error) error {
+	var rerr rados.RadosError
+	if !errors.As(err, &rerr) || rerr >= 0 {
+		return err
+	}
+	switch errno := syscall.Errno(-rerr); errno {
+	case syscall.ENOENT:
+		return os.ErrNotExist
+	case syscall.EEXIST:
+		return os.ErrExist
+	case syscall.EPERM, syscall.EACCES:
+		return os.ErrPermission
+	case syscall.EDQUOT:
+		return syscall.ENOSPC
+	default:
+		return errno
+	}
+}
+
+// pathError replaces *err, the error of op on path, by a *os.PathError. The
+// path error of a nested operation is replaced, so the outermost one is
+// reported. It is deferred by the methods of Orfs and File:
+//
+//	defer pathError("mkdir", name, &err)
+func pathError(op, path string, err *error) {
+	if *err == nil || *err == io.EOF {
+		return
+	}
+	*err = &os.PathError{Op: op, Path: path, Err: mapError(unwrapPathError(*err))}
+}
+
+// linkError is pathError for operations on two names.
+func linkError(op, oldName, newName string, err *error) {
+	if *err == nil {
+		return
+	}
+	*err = &os.LinkError{Op: op, Old: oldName, New: newName, Err: mapError(unwrapPathError(*err))}
+}
+
+func unwrapPathError(err error) error {
+	var perr *os.PathError
+	var lerr *os.LinkError
+	if errors.As(err, &perr) {
+		return perr.Err
+	} else if errors.As(err, &lerr) {
+		return lerr.Err
+	}
+	return err
+}
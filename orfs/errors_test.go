@@ -0,0 +1,68 @@
+package orfs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ceph/go-ceph/rados"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPathError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want error
+	}{
+		{rados.RadosErrorNotFound, os.ErrNotExist},
+		{rados.RadosError(-int(syscall.EEXIST)), os.ErrExist},
+		{rados.RadosError(-int(syscall.EACCES)), os.ErrPermission},
+		{rados.RadosError(-int(syscall.EDQUOT)), syscall.ENOSPC},
+		{rados.RadosError(-int(syscall.EBUSY)), syscall.EBUSY},
+		{syscall.ENOTEMPTY, syscall.ENOTEMPTY},
+		{MdEntryInvalid, ErrCorruptMetadata},
+		{fmt.Errorf("%w: status", ErrCorruptMetadata), ErrCorruptMetadata},
+	} {
+		err := tc.err
+		pathError("stat", "/a", &err)
+		var perr *os.PathError
+		if !errors.As(err, &perr) || perr.Op != "stat" || perr.Path != "/a" {
+			t.Errorf("%v not wrapped in a path error: %#v", tc.err, err)
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%v is not %v: %v", tc.err, tc.want, err)
+		}
+	}
+
+	err := error(io.EOF)
+	pathError("read", "/a", &err)
+	if err != io.EOF {
+		t.Errorf("EOF wrapped: %v", err)
+	}
+	var nilErr error
+	pathError("read", "/a", &nilErr)
+	if nilErr != nil {
+		t.Errorf("nil wrapped: %v", nilErr)
+	}
+
+	// The error of the outermost operation is reported.
+	err = os.ErrNotExist
+	pathError("lookup", "/a", &err)
+	linkError("rename", "/a", "/b", &err)
+	var lerr *os.LinkError
+	if !errors.As(err, &lerr) || lerr.Op != "rename" || lerr.Err != os.ErrNotExist {
+		t.Errorf("Nested error not replaced: %#v", err)
+	}
+}
+
+func TestRemoveAllInvalid(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	for _, name := range []string{"", "/", "//", "/a/.", "/a/.."} {
+		err := fs.RemoveAll(name)
+		var perr *os.PathError
+		if !errors.As(err, &perr) || perr.Op != "removeall" || perr.Path != name || perr.Err != os.ErrInvalid {
+			t.Errorf("RemoveAll(%q) returned %#v", name, err)
+		}
+	}
+}
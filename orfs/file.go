@@ -1,8 +1,13 @@
 package orfs
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 const BLOCKSIZE int64 = 1024 * 1024 * 4
@@ -16,64 +21,252 @@ type Inode interface {
 	Close() error
 }
 
+// File is an open file or directory. A File can be shared by several
+// goroutines, Read, Write and Seek serialize on the file position while
+// ReadAt and WriteAt don't use it and run concurrently.
 type File struct {
-	Inode  *fsObj
-	dInode string
-	fs     *Orfs
-	pos    int64
+	Inode *fsObj
+	fs    *Orfs
+	pos   int64
+	flag  int
+	mu    sync.Mutex
+	// Write buffer, unused unless enabled with SetWriteBuffer.
+	wb    writeBuffer
+	ra    readAhead
+	lease lease
+	// Set by Close, the methods then return os.ErrClosed.
+	closed atomic.Bool
+	// Directory and name the file was opened by, their entry is updated
+	// by Sync.
+	dir  *fsObj
+	name string
+	// Name of the file in errors.
+	path string
+}
+
+func (f *File) readable() bool {
+	return f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *File) writable() bool {
+	return f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_RDONLY
 }
 
 func (f *File) Close() error {
-	fmt.Fprintf(debuglog, "Close: %v\n", f.Inode.Inode())
-	f.Inode.ReSync()
+	return f.CloseContext(context.Background())
+}
+
+// CloseContext is Close with a context.
+func (f *File) CloseContext(ctx context.Context) (err error) {
+	defer pathError("close", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "Close", slog.Any("inode", f.Inode.Inode()))
+	defer end(&err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	err = f.SyncContext(ctx)
+	f.closed.Store(true)
+	f.lease.mu.Lock()
+	f.releaseLease()
+	f.lease.mu.Unlock()
 	f.pos = 0
+	if f.fs != nil {
+		f.fs.unregisterFile(f)
+	}
 	f.fs = nil
-	return nil
+	return err
 }
 
 func (f *File) Read(p []byte) (int, error) {
-	fmt.Fprintf(debuglog, "Read: %v, pos: %v\n", f.Inode.Inode(), f.pos)
-	read, err := f.fs.ioctx.Read(f.dInode, p, uint64(f.pos)) // FIXME, this is stupidly ugly, we should stripe data over multiple blocks.
-	fmt.Printf("File Read: GOT DATA: %v\n", p)
+	return f.ReadContext(context.Background(), p)
+}
+
+// ReadContext is Read with a context.
+func (f *File) ReadContext(ctx context.Context, p []byte) (_ int, err error) {
+	defer pathError("read", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "Read", slog.Any("inode", f.Inode.Inode()), slog.Int("len", len(p)))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.readable() {
+		return 0, syscall.EBADF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return 0, err
+	}
+	f.lease.mu.Lock()
+	defer f.lease.mu.Unlock()
+	read, err := f.ra.read(ctx, f.Inode, p, f.pos, func() bool {
+		return f.holdLease(leaseShared)
+	})
 	f.pos += int64(read)
 	return read, err
 }
 
-func (f *File) Seek(offset int64, whence int) (int64, error) {
-	fmt.Fprintf(debuglog, "Seek: %v, pos: %v, whence: %v\n", f.dInode, offset, whence)
+// ReadAt reads len(p) bytes at off without using or changing the file
+// position, like io.ReaderAt it returns an error if it reads less.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt with a context.
+func (f *File) ReadAtContext(ctx context.Context, p []byte, off int64) (_ int, err error) {
+	defer pathError("read", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "ReadAt", slog.Any("inode", f.Inode.Inode()), slog.Int64("off", off), slog.Int("len", len(p)))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.readable() {
+		return 0, syscall.EBADF
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if err := f.flush(ctx); err != nil {
+		return 0, err
+	}
+	read, err := f.Inode.readBlocks(ctx, p, off)
+	if err == nil && read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (f *File) Seek(offset int64, whence int) (_ int64, err error) {
+	defer pathError("seek", f.path, &err)
+	f.Inode.fs.logger.Debug("Seek", "inode", f.Inode.Inode(), "offset", offset, "whence", whence)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	pos := offset
 	switch whence {
-	case 0: // Seek from start of file
-		f.pos = offset
-	case 1: // Seek from current position
-		f.pos += offset
-	case 2: // Seek from end of file
+	case io.SeekStart: // Seek from start of file
+	case io.SeekCurrent: // Seek from current position
+		pos += f.pos
+	case io.SeekEnd: // Seek from end of file
 		stat, err := f.Stat()
 		if err != nil {
-			return int64(f.pos), fmt.Errorf("Failed to get current object size")
+			return int64(f.pos), err
 		}
-		f.pos = stat.Size() + offset
+		pos += stat.Size()
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if pos < 0 {
+		return f.pos, os.ErrInvalid
 	}
-	return int64(f.pos), nil
+	if pos != f.pos {
+		f.ra.invalidate()
+	}
+	f.pos = pos
+	return f.pos, nil
 }
 
 func (f *File) Write(p []byte) (int, error) {
-	fmt.Fprintf(debuglog, "Write: %v\n", f.Inode)
-	err := f.fs.ioctx.Write(f.dInode, p, uint64(f.pos))
-	if err != nil {
-		// If error, assume nothing was written. Ceph should be fully
-		// consistent and if write fails without info on how much was
-		// written, we have to assume it was aborted.
+	return f.WriteContext(context.Background(), p)
+}
+
+// WriteContext is Write with a context.
+func (f *File) WriteContext(ctx context.Context, p []byte) (_ int, err error) {
+	defer pathError("write", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "Write", slog.Any("inode", f.Inode.Inode()), slog.Int("len", len(p)))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.writable() {
+		return 0, syscall.EBADF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ra.invalidate()
+	if f.buffered() {
+		f.lease.mu.Lock()
+		if f.holdLease(leaseExclusive) {
+			defer f.lease.mu.Unlock()
+			return f.bufferWrite(ctx, p)
+		}
+		f.lease.mu.Unlock()
+		// Another client uses the file, write through.
+		if err := f.flush(ctx); err != nil {
+			return 0, err
+		}
+	}
+	f.holdWriteLease(ctx)
+	defer f.holdWriteLease(ctx)
+	if f.flag&os.O_APPEND != 0 {
+		end, written, err := f.Inode.appendBlocks(ctx, p)
+		f.pos = end
+		return written, err
+	}
+	written, err := f.Inode.writeBlocks(ctx, p, f.pos)
+	f.pos += int64(written)
+	return written, err
+}
+
+// WriteAt writes p at off without using or changing the file position.
+// Like os.File it is an error on a file opened with O_APPEND.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), p, off)
+}
+
+// WriteAtContext is WriteAt with a context.
+func (f *File) WriteAtContext(ctx context.Context, p []byte, off int64) (_ int, err error) {
+	defer pathError("write", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "WriteAt", slog.Any("inode", f.Inode.Inode()), slog.Int64("off", off), slog.Int("len", len(p)))
+	defer end(&err)
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !f.writable() {
+		return 0, syscall.EBADF
+	}
+	if f.flag&os.O_APPEND != 0 || off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if err := f.flush(ctx); err != nil {
 		return 0, err
 	}
-	f.pos += int64(len(p))
-	if f.pos > f.Inode.size {
-		f.Inode.size = f.pos
+	f.ra.invalidate()
+	f.holdWriteLease(ctx)
+	defer f.holdWriteLease(ctx)
+	return f.Inode.writeBlocks(ctx, p, off)
+}
+
+// Changes the size of the file, the position is not changed.
+func (f *File) Truncate(size int64) (err error) {
+	defer pathError("truncate", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(context.Background(), "Truncate", slog.Any("inode", f.Inode.Inode()), slog.Int64("size", size))
+	defer end(&err)
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	if !f.writable() {
+		return syscall.EBADF
+	}
+	if err := f.flush(ctx); err != nil {
+		return err
 	}
-	return len(p), nil
+	f.ra.invalidate()
+	f.holdWriteLease(ctx)
+	defer f.holdWriteLease(ctx)
+	return f.Inode.truncate(ctx, size)
 }
 
-func (f *File) Readdir(count int) ([]os.FileInfo, error) {
-	fmt.Fprintf(debuglog, "Readdir: %v\n", f.Inode.Inode())
+func (f *File) Readdir(count int) (_ []os.FileInfo, err error) {
+	defer pathError("readdir", f.path, &err)
+	f.Inode.fs.logger.Debug("Readdir", "inode", f.Inode.Inode())
+	if f.closed.Load() {
+		return nil, os.ErrClosed
+	}
 	var ret []os.FileInfo
 	fsObjList, err := f.Inode.List()
 	for _, v := range fsObjList {
@@ -82,7 +275,14 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 	return ret, err
 }
 
-func (f *File) Stat() (os.FileInfo, error) {
-	fmt.Fprintf(debuglog, "Stat'ing: %v\n", f.Inode.Inode())
+func (f *File) Stat() (_ os.FileInfo, err error) {
+	defer pathError("stat", f.path, &err)
+	f.Inode.fs.logger.Debug("Stat", "inode", f.Inode.Inode())
+	if f.closed.Load() {
+		return nil, os.ErrClosed
+	}
+	if err := f.flush(context.Background()); err != nil {
+		return nil, err
+	}
 	return f.Inode, nil
 }
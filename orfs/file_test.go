@@ -0,0 +1,69 @@
+package orfs
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testFile() *File {
+	fs, _ := NewORFS("a", "a", 10)
+	obj := &fsObj{name: "f", inode: uuid.New(), fs: fs, mode: 0644, children: make(map[string]uuid.UUID)}
+	return &File{Inode: obj, fs: fs, flag: os.O_RDWR, path: "/f"}
+}
+
+func TestFileClosed(t *testing.T) {
+	f := testFile()
+	f.closed.Store(true)
+	p := make([]byte, 1)
+	calls := map[string]func() error{
+		"Close":          f.Close,
+		"Read":           func() error { _, err := f.Read(p); return err },
+		"ReadAt":         func() error { _, err := f.ReadAt(p, 0); return err },
+		"Write":          func() error { _, err := f.Write(p); return err },
+		"WriteAt":        func() error { _, err := f.WriteAt(p, 0); return err },
+		"Seek":           func() error { _, err := f.Seek(0, io.SeekStart); return err },
+		"Truncate":       func() error { return f.Truncate(0) },
+		"Sync":           f.Sync,
+		"Stat":           func() error { _, err := f.Stat(); return err },
+		"Readdir":        func() error { _, err := f.Readdir(0); return err },
+		"SetWriteBuffer": func() error { return f.SetWriteBuffer(1, 0) },
+	}
+	for name, call := range calls {
+		err := call()
+		var perr *os.PathError
+		if !errors.As(err, &perr) || perr.Path != "/f" || !errors.Is(err, os.ErrClosed) {
+			t.Errorf("%v on a closed file returned %#v", name, err)
+		}
+	}
+}
+
+func TestSetWriteBufferConcurrentFlush(t *testing.T) {
+	f := testFile()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.SetWriteBuffer((i+j)%2*1024, time.Second)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := f.flush(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+				f.buffered()
+			}
+		}()
+	}
+	wg.Wait()
+}
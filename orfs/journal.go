@@ -0,0 +1,452 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/google/uuid"
+	"github.com/howeyc/crc16"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Name of the journal object in the metadata pool.
+const journalObject = "orfs.journal"
+
+// Renames hold the journal lock shared while they run, recovery holds it
+// exclusive while it replays and compacts the journal. The lock expires so
+// a crashed client can't block recovery forever.
+const journalLock = "Journal"
+
+var JournalEntryInvalid error = corruptError("Journal entry is invalid")
+
+// A rename intent as recorded in the journal.
+// kind is 'R' for a rename, which replaces target if it is set, and 'X'
+// for an exchange of inode and target.
+type renameIntent struct {
+	id          uuid.UUID
+	kind        byte
+	oldDir      uuid.UUID
+	newDir      uuid.UUID
+	inode       uuid.UUID
+	isDir       bool
+	target      uuid.UUID
+	targetIsDir bool
+	oldName     string
+	newName     string
+}
+
+// makeJournalIntent encodes a rename intent, the format is:
+// R|X;id;olddir;newdir;inode;d|f;target;d|f;len;oldname;len;newname;crc
+func makeJournalIntent(r *renameIntent) []byte {
+	entry := []byte{r.kind}
+	entry = append(entry, ';')
+	entry = append(entry, r.id.String()...)
+	entry = append(entry, ';')
+	entry = append(entry, r.oldDir.String()...)
+	entry = append(entry, ';')
+	entry = append(entry, r.newDir.String()...)
+	for _, i := range []struct {
+		inode uuid.UUID
+		isDir bool
+	}{{r.inode, r.isDir}, {r.target, r.targetIsDir}} {
+		entry = append(entry, ';')
+		entry = append(entry, i.inode.String()...)
+		entry = append(entry, ';')
+		if i.isDir {
+			entry = append(entry, 'd')
+		} else {
+			entry = append(entry, 'f')
+		}
+	}
+	for _, name := range []string{r.oldName, r.newName} {
+		entry = append(entry, ';')
+		entry = append(entry, []byte(strconv.FormatUint(uint64(len(name)), 10))...)
+		entry = append(entry, ';')
+		entry = append(entry, []byte(name)...)
+	}
+	return appendJournalCrc(entry)
+}
+
+// makeJournalCommit encodes the commit record for intent id: C;id;crc
+func makeJournalCommit(id uuid.UUID) []byte {
+	entry := []byte{'C'}
+	entry = append(entry, ';')
+	entry = append(entry, id.String()...)
+	return appendJournalCrc(entry)
+}
+
+func appendJournalCrc(entry []byte) []byte {
+	crc := crc16.ChecksumCCITT(entry)
+	entry = append(entry, ';')
+	entry = append(entry, []byte(strconv.FormatUint(uint64(crc), 16))...)
+	return append(entry, '\n')
+}
+
+// parseJournalEntry parses one line of the journal. For commit records
+// only the id of the returned intent is set.
+func parseJournalEntry(entry []byte) (byte, *renameIntent, error) {
+	if len(entry) == 0 {
+		return 0x0, nil, MdEntryEmpty
+	}
+	crcPos := strings.LastIndexByte(string(entry), ';')
+	if crcPos < 0 {
+		return 0x0, nil, JournalEntryInvalid
+	}
+	crc, err := strconv.ParseUint(string(entry[crcPos+1:]), 16, 16)
+	if err != nil || uint16(crc) != crc16.ChecksumCCITT(entry[:crcPos]) {
+		return 0x0, nil, JournalEntryInvalid
+	}
+	entry = entry[:crcPos]
+
+	if len(entry) < 2 || entry[1] != ';' {
+		return 0x0, nil, JournalEntryInvalid
+	}
+	r := &renameIntent{kind: entry[0]}
+	readUUID := func(pos int) (uuid.UUID, int, error) {
+		if pos+36 > len(entry) {
+			return uuid.UUID{}, pos, JournalEntryInvalid
+		}
+		u, err := uuid.Parse(string(entry[pos : pos+36]))
+		return u, pos + 36 + 1, err
+	}
+	readName := func(pos int) (string, int, error) {
+		end := strings.IndexByte(string(entry[pos:]), ';')
+		if end < 0 {
+			return "", pos, JournalEntryInvalid
+		}
+		nLength, err := strconv.ParseUint(string(entry[pos:pos+end]), 10, 64)
+		if err != nil {
+			return "", pos, JournalEntryInvalid
+		}
+		pos += end + 1
+		if uint64(pos)+nLength > uint64(len(entry)) {
+			return "", pos, JournalEntryInvalid
+		}
+		return string(entry[pos : uint64(pos)+nLength]), pos + int(nLength) + 1, nil
+	}
+
+	state := entry[0]
+	pos := 2
+	if r.id, pos, err = readUUID(pos); err != nil {
+		return 0x0, nil, err
+	}
+	switch state {
+	case 'C':
+		return state, r, nil
+	case 'R', 'X':
+	default:
+		return 0x0, nil, JournalEntryInvalid
+	}
+	if r.oldDir, pos, err = readUUID(pos); err != nil {
+		return 0x0, nil, err
+	}
+	if r.newDir, pos, err = readUUID(pos); err != nil {
+		return 0x0, nil, err
+	}
+	if r.inode, pos, err = readUUID(pos); err != nil {
+		return 0x0, nil, err
+	}
+	if pos >= len(entry) {
+		return 0x0, nil, JournalEntryInvalid
+	}
+	r.isDir = entry[pos] == 'd'
+	pos += 2
+	if r.target, pos, err = readUUID(pos); err != nil {
+		return 0x0, nil, err
+	}
+	if pos >= len(entry) {
+		return 0x0, nil, JournalEntryInvalid
+	}
+	r.targetIsDir = entry[pos] == 'd'
+	pos += 2
+	if r.oldName, pos, err = readName(pos); err != nil {
+		return 0x0, nil, err
+	}
+	if r.newName, pos, err = readName(pos); err != nil {
+		return 0x0, nil, err
+	}
+	return state, r, nil
+}
+
+// journalBegin records the intent in the journal and takes the shared
+// journal lock, which is held until the returned function is called.
+func (fs *Orfs) journalBegin(ctx context.Context, r *renameIntent) (func(), error) {
+	ioctx, _, unpin, err := fs.connection(true)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockShared(ctx, fs.metrics, ioctx, journalObject, journalLock, r.id.String(), "rename", "Rename in progress")
+	if err != nil {
+		unpin()
+		return nil, err
+	}
+	release := func() {
+		unlock()
+		unpin()
+	}
+	_, span := fs.journalSpan(ctx, "rados.Append")
+	err = ioctx.Append(journalObject, makeJournalIntent(r))
+	endSpan(span, err)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// journalCommit marks the intent as completed.
+func (fs *Orfs) journalCommit(ctx context.Context, r *renameIntent) error {
+	_, span := fs.journalSpan(ctx, "rados.Append")
+	err := fs.call(true, func(ioctx *rados.IOContext) error {
+		return ioctx.Append(journalObject, makeJournalCommit(r.id))
+	})
+	endSpan(span, err)
+	return err
+}
+
+// journalSpan starts a span for a call on the journal object.
+func (fs *Orfs) journalSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return startSpan(ctx, name,
+		attribute.String("rados.pool", fs.mdpool),
+		attribute.String("rados.object", journalObject))
+}
+
+// readJournal returns all intents in the journal which have no commit record.
+func (fs *Orfs) readJournal() ([]*renameIntent, error) {
+	var buf []byte
+	err := fs.call(true, func(ioctx *rados.IOContext) error {
+		stat, err := ioctx.Stat(journalObject)
+		if err != nil {
+			return err
+		}
+		buf = make([]byte, stat.Size)
+		n, err := ioctx.Read(journalObject, buf, 0)
+		buf = buf[:n]
+		return err
+	})
+	if err == rados.RadosErrorNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return fs.pendingIntents(buf), nil
+}
+
+// pendingIntents returns the intents in the journal buf which have no commit
+// record, in the order they were recorded.
+func (fs *Orfs) pendingIntents(buf []byte) []*renameIntent {
+	var pending []*renameIntent
+	committed := make(map[uuid.UUID]bool)
+	for _, line := range strings.Split(string(buf), "\n") {
+		state, r, err := parseJournalEntry([]byte(line))
+		if err == MdEntryEmpty {
+			continue
+		} else if err != nil {
+			// A torn append from a crashed client, the intent never
+			// started so there is nothing to replay.
+			fs.logger.Warn("Skipping invalid journal entry", "entry", line, "error", err)
+			continue
+		}
+		if state == 'C' {
+			committed[r.id] = true
+			continue
+		}
+		pending = append(pending, r)
+	}
+
+	ret := pending[:0]
+	for _, r := range pending {
+		if !committed[r.id] {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// Size past which renames compact the journal, see compactJournal.
+const journalCompactSize = 64 * 1024
+
+// compactJournal truncates the journal once it has grown past
+// journalCompactSize, so it doesn't grow without bound between Connects.
+// This is recovery run online, it only proceeds when no rename holds the
+// journal lock, so every intent left is committed or was left by a crashed
+// client.
+func (fs *Orfs) compactJournal(ctx context.Context) {
+	var size uint64
+	_, span := fs.journalSpan(ctx, "rados.Stat")
+	err := fs.call(true, func(ioctx *rados.IOContext) error {
+		stat, err := ioctx.Stat(journalObject)
+		size = stat.Size
+		return err
+	})
+	endSpan(span, err)
+	if err != nil || size < journalCompactSize {
+		return
+	}
+	if err := fs.recoverJournal(ctx); err != nil {
+		fs.logger.Warn("Failed to compact the journal", "error", err)
+	}
+}
+
+// recoverJournal replays or rolls back every rename which didn't complete
+// and compacts the journal. It is a no-op while another client is renaming.
+func (fs *Orfs) recoverJournal(ctx context.Context) error {
+	return fs.call(true, func(ioctx *rados.IOContext) error {
+		cookie := uuid.New().String()
+		lock := func(flags *byte) (int, error) {
+			return ioctx.LockExclusive(journalObject, journalLock, cookie, "Journal recovery", lockDuration, flags)
+		}
+		ret, err := lock(nil)
+		if err != nil {
+			return err
+		}
+		if ret != 0 {
+			fs.logger.Debug("Journal busy, skipping recovery")
+			return nil
+		}
+		defer holdLock(ioctx, journalObject, journalLock, cookie, lock)()
+
+		intents, err := fs.readJournal()
+		if err != nil {
+			return err
+		}
+		for _, r := range intents {
+			fs.logger.Info("Recovering rename", "id", r.id, "inode", r.inode, "old_dir", r.oldDir, "old_name", r.oldName, "new_dir", r.newDir, "new_name", r.newName)
+			if err := fs.replayRename(ctx, r); err != nil {
+				return err
+			}
+		}
+		return ioctx.Truncate(journalObject, 0)
+	})
+}
+
+// replayRename completes an interrupted rename. As long as the inode still
+// exists the rename is rolled forward, if it is gone it was removed after
+// the crash and any entry added to the new directory is rolled back.
+func (fs *Orfs) replayRename(ctx context.Context, r *renameIntent) error {
+	oldDir, err := getInode(fs, r.oldDir, true)
+	if err == rados.RadosErrorNotFound {
+		return fs.journalCommit(ctx, r)
+	} else if err != nil {
+		return err
+	}
+	newDir, err := getInode(fs, r.newDir, true)
+	if err == rados.RadosErrorNotFound {
+		return fs.journalCommit(ctx, r)
+	} else if err != nil {
+		return err
+	}
+
+	err = fs.call(r.isDir, func(ioctx *rados.IOContext) error {
+		_, err := ioctx.Stat(r.inode.String())
+		return err
+	})
+	if err == rados.RadosErrorNotFound {
+		if linkedAt(newDir, r.newName) == r.inode {
+			err := updateContext(ctx, newDir, []OrfsStat{&Istat{name: r.newName, isDir: r.isDir, inode: r.inode, nlink: 1}}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	} else if err := fs.applyRename(ctx, r, oldDir, newDir); err != nil && err != os.ErrExist {
+		// ErrExist means someone else took the name after the crash,
+		// the rename is then rolled back by leaving the old link.
+		return err
+	}
+	return fs.journalCommit(ctx, r)
+}
+
+// linkedAt returns the inode linked as name in dir, or the zero uuid.
+func linkedAt(dir OBJ, name string) uuid.UUID {
+	if !dir.HasChild(name) {
+		return uuid.UUID{}
+	}
+	child, err := dir.Get(name)
+	if err != nil {
+		return uuid.UUID{}
+	}
+	return child.Inode()
+}
+
+// applyRename brings the directories to the state described by the intent.
+// Each step checks the current state of the directories first so that it
+// can be run again by recovery no matter where a previous attempt stopped.
+// Within a single directory the whole rename is one atomic append.
+func (fs *Orfs) applyRename(ctx context.Context, r *renameIntent, oldDir, newDir OBJ) error {
+	obj, err := getInode(fs, r.inode, r.isDir)
+	if err != nil {
+		return err
+	}
+	var target OBJ
+	if r.target != (uuid.UUID{}) {
+		if target, err = getInode(fs, r.target, r.targetIsDir); err != nil && err != rados.RadosErrorNotFound {
+			return err
+		}
+	}
+	atOld := linkedAt(oldDir, r.oldName)
+	atNew := linkedAt(newDir, r.newName)
+	sameDir := r.oldDir == r.newDir
+
+	if r.kind == 'X' {
+		if target == nil {
+			return os.ErrNotExist
+		}
+		if sameDir && atOld == r.inode && atNew == r.target {
+			rm := []OrfsStat{renamedStat(obj, r.oldName), renamedStat(target, r.newName)}
+			obj.Rename(r.newName)
+			target.Rename(r.oldName)
+			return updateContext(ctx, newDir, rm, []OrfsStat{obj, target})
+		}
+		if atNew == r.target {
+			rm := []OrfsStat{renamedStat(target, r.newName)}
+			obj.Rename(r.newName)
+			if err := updateContext(ctx, newDir, rm, []OrfsStat{obj}); err != nil {
+				return err
+			}
+		}
+		if atOld == r.inode {
+			rm := []OrfsStat{renamedStat(obj, r.oldName)}
+			target.Rename(r.oldName)
+			if err := updateContext(ctx, oldDir, rm, []OrfsStat{target}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if atNew != r.inode {
+		if atNew != (uuid.UUID{}) && atNew != r.target {
+			return os.ErrExist
+		}
+		var rm []OrfsStat
+		if atNew != (uuid.UUID{}) {
+			rm = append(rm, &Istat{name: r.newName, isDir: r.targetIsDir, inode: atNew, nlink: 1})
+		}
+		if sameDir && atOld == r.inode {
+			rm = append(rm, renamedStat(obj, r.oldName))
+			atOld = uuid.UUID{}
+		}
+		obj.Rename(r.newName)
+		if err := updateContext(ctx, newDir, rm, []OrfsStat{obj}); err != nil {
+			return err
+		}
+	}
+	if atOld == r.inode && !(sameDir && r.oldName == r.newName) {
+		if err := updateContext(ctx, oldDir, []OrfsStat{renamedStat(obj, r.oldName)}, nil); err != nil {
+			return err
+		}
+	}
+	if target != nil && atNew == r.target {
+		// Drop the link of the replaced target. If recovery runs after the
+		// replace this is skipped, at worst leaking the target inode.
+		if err := addLinkContext(ctx, target, -1); err != nil && err != rados.RadosErrorNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package orfs
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestJournalEntryRoundTrip(t *testing.T) {
+	for _, r := range []*renameIntent{
+		{kind: 'R', oldName: "a", newName: "b"},
+		{kind: 'R', isDir: true, oldName: "dir", newName: "moved dir"},
+		{kind: 'R', target: uuid.New(), oldName: "new", newName: "old"},
+		{kind: 'X', target: uuid.New(), targetIsDir: true, isDir: true, oldName: "x;y", newName: ""},
+	} {
+		r.id, r.oldDir, r.newDir, r.inode = uuid.New(), uuid.New(), uuid.New(), uuid.New()
+		entry := makeJournalIntent(r)
+		state, got, err := parseJournalEntry(entry[:len(entry)-1])
+		if err != nil {
+			t.Errorf("parseJournalEntry(%q): %v", entry, err)
+			continue
+		}
+		if state != r.kind || *got != *r {
+			t.Errorf("parseJournalEntry(%q) = %c %+v, want %+v", entry, state, got, r)
+		}
+	}
+
+	id := uuid.New()
+	entry := makeJournalCommit(id)
+	state, got, err := parseJournalEntry(entry[:len(entry)-1])
+	if err != nil || state != 'C' || got.id != id {
+		t.Errorf("parseJournalEntry(%q) = %c %+v, %v", entry, state, got, err)
+	}
+}
+
+func TestJournalEntryInvalid(t *testing.T) {
+	r := &renameIntent{kind: 'R', id: uuid.New(), oldName: "a", newName: "b"}
+	entry := makeJournalIntent(r)
+	entry = entry[:len(entry)-1]
+	for _, bad := range [][]byte{
+		[]byte("R"),
+		[]byte("C;1234;0"),
+		entry[:len(entry)/2],
+		append([]byte{'Z'}, entry[1:]...),
+	} {
+		if _, _, err := parseJournalEntry(bad); err == nil {
+			t.Errorf("parseJournalEntry(%q) accepted", bad)
+		}
+	}
+}
+
+func TestPendingIntents(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	intents := make([]*renameIntent, 3)
+	for i := range intents {
+		intents[i] = &renameIntent{kind: 'R', id: uuid.New(), oldName: "a", newName: "b"}
+	}
+	a, b, c := makeJournalIntent(intents[0]), makeJournalIntent(intents[1]), makeJournalIntent(intents[2])
+	commit := func(i int) []byte { return makeJournalCommit(intents[i].id) }
+	join := func(entries ...[]byte) []byte { return bytes.Join(entries, nil) }
+
+	tests := []struct {
+		name    string
+		journal []byte
+		want    []int
+	}{
+		{"empty", nil, nil},
+		{"committed", join(a, commit(0)), nil},
+		{"pending", join(a, b), []int{0, 1}},
+		{"interleaved", join(a, b, commit(0), c), []int{1, 2}},
+		// A commit is found wherever it is, recovery appends them late.
+		{"commit before intent", join(commit(1), a, b), []int{0}},
+		{"torn intent", join(a, commit(0), b[:len(b)/2]), nil},
+		{"torn commit", join(a, b, commit(1)[:10]), []int{0, 1}},
+	}
+	for _, test := range tests {
+		got := fs.pendingIntents(test.journal)
+		if len(got) != len(test.want) {
+			t.Errorf("%v: %v pending intents, want %v", test.name, len(got), len(test.want))
+			continue
+		}
+		for i, r := range got {
+			if r.id != intents[test.want[i]].id {
+				t.Errorf("%v: intent %v is %v, want %v", test.name, i, r.id, intents[test.want[i]].id)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Open files cache data between calls, the write buffer holds data which
+// isn't in RADOS yet and read-ahead holds data another client may overwrite.
+// A File only uses these caches while it holds a lease on the inode, a
+// shared lease for read-ahead and an exclusive one for the write buffer.
+//
+// Leases are RADOS locks on the inode object which expire unless they are
+// renewed. A client which can't get a lease because of a conflicting one
+// notifies the inode, the holders then flush, drop their caches and release
+// their leases before acknowledging. A File which still can't get its lease
+// reads and writes RADOS directly. Directories don't need leases, the
+// watches in watch.go keep them coherent.
+
+const (
+	leaseShared = iota + 1
+	leaseExclusive
+)
+
+const leaseLock = "Lease"
+
+// How long a lease is granted for, it is renewed on use when less than
+// leaseRenewMargin is left.
+const (
+	leaseDuration    = 30 * time.Second
+	leaseRenewMargin = 5 * time.Second
+)
+
+// LIBRADOS_LOCK_FLAG_RENEW
+const lockFlagRenew byte = 1
+
+// lease is the lease a File holds on its inode.
+type lease struct {
+	// Held while the caches protected by the lease are used.
+	mu      sync.Mutex
+	kind    int
+	cookie  string
+	expires time.Time
+}
+
+// holdLease makes sure the file holds a lease of at least kind, it reports
+// false if a conflicting lease couldn't be revoked. The caller holds
+// f.lease.mu.
+func (f *File) holdLease(kind int) bool {
+	l := &f.lease
+	if f.Inode.IsDir() {
+		return false
+	}
+	if l.kind >= kind && time.Now().Add(leaseRenewMargin).Before(l.expires) {
+		return true
+	}
+	fs := f.Inode.fs
+	if l.kind != 0 && l.kind < kind {
+		// RADOS can't upgrade a shared lock.
+		f.releaseLease()
+	}
+	renew := l.kind != 0
+	if !renew {
+		l.cookie = uuid.New().String()
+		fs.registerLease(f, false)
+		// Watch before locking, so no revoke is missed.
+		if !fs.watch(f.Inode.Inode(), false) {
+			fs.unregisterLease(f)
+			return false
+		}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		granted := time.Now()
+		ret, err := f.lockLease(kind, renew)
+		if err == nil && ret == 0 {
+			l.kind = kind
+			l.expires = granted.Add(leaseDuration)
+			if !renew {
+				fs.registerLease(f, true)
+				// Another client may have changed the file since we
+				// last read it.
+				f.Inode.ReadMD()
+			}
+			return true
+		}
+		if err != nil || attempt > 0 {
+			fs.logger.Debug("Lease not granted", "inode", f.Inode.Inode(), "kind", kind, "ret", ret, "error", err)
+			break
+		}
+		fs.sendNotify(context.Background(), f.Inode.Inode(), false, notifyRevoke, "")
+	}
+	if l.kind != 0 {
+		// Renewal failed, the lease is gone.
+		f.releaseLease()
+	} else {
+		fs.unregisterLease(f)
+	}
+	return false
+}
+
+func (f *File) lockLease(kind int, renew bool) (int, error) {
+	var flags byte
+	if renew {
+		flags = lockFlagRenew
+	}
+	oid := f.Inode.Inode().String()
+	var ret int
+	err := f.Inode.fs.call(false, func(ioctx *rados.IOContext) (err error) {
+		if kind == leaseExclusive {
+			ret, err = ioctx.LockExclusive(oid, leaseLock, f.lease.cookie, "ORFS lease", leaseDuration, &flags)
+		} else {
+			ret, err = ioctx.LockShared(oid, leaseLock, f.lease.cookie, "", "ORFS lease", leaseDuration, &flags)
+		}
+		return err
+	})
+	return ret, err
+}
+
+// releaseLease writes out and drops everything cached under the lease and
+// releases it. The caller holds f.lease.mu.
+func (f *File) releaseLease() {
+	l := &f.lease
+	if l.kind == 0 {
+		return
+	}
+	f.Inode.fs.logger.Debug("Release lease", "inode", f.Inode.Inode(), "kind", l.kind)
+	if err := f.flush(context.Background()); err != nil {
+		// Keep the error for the next call on the file.
+		f.wb.mu.Lock()
+		f.wb.err = err
+		f.wb.mu.Unlock()
+	}
+	f.Inode.commit(context.Background())
+	f.ra.invalidate()
+	fs := f.Inode.fs
+	fs.call(false, func(ioctx *rados.IOContext) error {
+		_, err := ioctx.Unlock(f.Inode.Inode().String(), leaseLock, l.cookie)
+		return err
+	})
+	l.kind = 0
+	fs.unregisterLease(f)
+}
+
+// holdWriteLease is called before and after data is written without the
+// write buffer. Taking the exclusive lease before makes other Files write out
+// their buffers and drop their caches, taking it again after catches a revoke
+// while writing. Without the lease the leases of the others are revoked
+// instead.
+func (f *File) holdWriteLease(ctx context.Context) {
+	f.lease.mu.Lock()
+	defer f.lease.mu.Unlock()
+	if !f.holdLease(leaseExclusive) {
+		f.Inode.fs.sendNotify(ctx, f.Inode.Inode(), false, notifyRevoke, "")
+	}
+}
+
+// truncate truncates obj without a File, the Files holding leases on it
+// write out their buffers before and drop their caches after.
+func (fs *Orfs) truncate(ctx context.Context, obj OBJ, size int64) error {
+	fs.sendNotify(ctx, obj.Inode(), false, notifyRevoke, "")
+	defer fs.sendNotify(ctx, obj.Inode(), false, notifyRevoke, "")
+	return truncateContext(ctx, obj, size)
+}
+
+// registerLease records that f holds or, if granted isn't set, is acquiring a
+// lease. Only granted leases are revoked, a File acquiring one is waiting for
+// the revoke it sent itself.
+func (fs *Orfs) registerLease(f *File, granted bool) {
+	fs.leaseMu.Lock()
+	defer fs.leaseMu.Unlock()
+	inode := f.Inode.Inode()
+	if fs.leases[inode] == nil {
+		fs.leases[inode] = make(map[*File]bool)
+	}
+	fs.leases[inode][f] = granted
+}
+
+// unregisterLease forgets the lease of f, the inode stops being watched
+// when its last lease is gone.
+func (fs *Orfs) unregisterLease(f *File) {
+	inode := f.Inode.Inode()
+	fs.leaseMu.Lock()
+	delete(fs.leases[inode], f)
+	last := len(fs.leases[inode]) == 0
+	if last {
+		delete(fs.leases, inode)
+	}
+	fs.leaseMu.Unlock()
+	if last {
+		// Revokes are handled on the goroutine of the watch, it can't
+		// delete its own watch.
+		go fs.unwatch(inode)
+	}
+}
+
+func (fs *Orfs) hasLeases(inode uuid.UUID) bool {
+	fs.leaseMu.Lock()
+	defer fs.leaseMu.Unlock()
+	return len(fs.leases[inode]) > 0
+}
+
+// revokeLeases releases all leases this client holds on inode.
+func (fs *Orfs) revokeLeases(inode uuid.UUID) {
+	fs.leaseMu.Lock()
+	var files []*File
+	for f, granted := range fs.leases[inode] {
+		if granted {
+			files = append(files, f)
+		}
+	}
+	fs.leaseMu.Unlock()
+	for _, f := range files {
+		f.lease.mu.Lock()
+		f.releaseLease()
+		f.lease.mu.Unlock()
+	}
+}
@@ -0,0 +1,219 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"math/rand"
+	"syscall"
+	"time"
+)
+
+// Locks on RADOS objects expire after lockDuration, a client which dies
+// holding one only blocks the object until then. A live client renews its
+// locks every lockRenewInterval while it holds them, however long the work
+// under them takes.
+const (
+	lockDuration      = 30 * time.Second
+	lockRenewInterval = lockDuration / 3
+)
+
+// How long to wait for a busy lock when the context has no deadline, long
+// enough for the lock of a dead client to expire.
+const lockWait = lockDuration + 5*time.Second
+
+// Bounds of the backoff between attempts to take a busy lock.
+const (
+	lockBackoffMin = 5 * time.Millisecond
+	lockBackoffMax = 500 * time.Millisecond
+)
+
+// Names of the locks ORFS takes on its objects.
+var lockNames = []string{"AddEntry", leaseLock, journalLock}
+
+// lockExclusive takes the exclusive lock name on oid. While the lock is
+// busy it retries with jittered exponential backoff until ctx is done, or
+// for lockWait if ctx has no deadline, and then returns syscall.EBUSY or the
+// error of ctx. The lock is renewed until the returned function is called,
+// which releases it.
+func lockExclusive(ctx context.Context, m *Metrics, ioctx *rados.IOContext, oid, name, cookie, desc string) (func(), error) {
+	return retryLock(ctx, m, ioctx, oid, name, cookie, func(flags *byte) (int, error) {
+		return ioctx.LockExclusive(oid, name, cookie, desc, lockDuration, flags)
+	})
+}
+
+// lockShared is lockExclusive for a shared lock.
+func lockShared(ctx context.Context, m *Metrics, ioctx *rados.IOContext, oid, name, cookie, tag, desc string) (func(), error) {
+	return retryLock(ctx, m, ioctx, oid, name, cookie, func(flags *byte) (int, error) {
+		return ioctx.LockShared(oid, name, cookie, tag, desc, lockDuration, flags)
+	})
+}
+
+// retryLock records the time it took to get the lock and the busy attempts
+// in m and in a span.
+func retryLock(ctx context.Context, m *Metrics, ioctx *rados.IOContext, oid, name, cookie string, lock func(flags *byte) (int, error)) (_ func(), err error) {
+	start := time.Now()
+	_, span := startSpan(ctx, "rados.Lock", attribute.String("rados.object", oid), attribute.String("rados.lock", name))
+	if span.IsRecording() {
+		pool, _ := ioctx.GetPoolName()
+		span.SetAttributes(attribute.String("rados.pool", pool))
+		if _, perr := uuid.Parse(oid); perr == nil {
+			span.SetAttributes(attribute.String("orfs.inode", oid))
+		}
+	}
+	retries := 0
+	defer func() {
+		m.lockWaited(name, start, retries, err)
+		span.SetAttributes(attribute.Int("rados.lock.retries", retries))
+		endSpan(span, err)
+	}()
+	wait := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, lockWait)
+		defer cancel()
+	}
+	backoff := lockBackoffMin
+	for ; ; retries++ {
+		ret, err := lock(nil)
+		if err != nil {
+			return nil, err
+		}
+		switch ret {
+		case 0:
+			return holdLock(ioctx, oid, name, cookie, lock), nil
+		case -int(syscall.EBUSY), -int(syscall.EEXIST):
+		default:
+			return nil, rados.RadosError(ret)
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-wait.Done():
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, syscall.EBUSY
+		case <-time.After(sleep):
+		}
+		if backoff *= 2; backoff > lockBackoffMax {
+			backoff = lockBackoffMax
+		}
+	}
+}
+
+// holdLock renews the lock taken with lock until the returned function is
+// called, which stops renewing and releases it. A failed renewal is tried
+// again at the next interval.
+func holdLock(ioctx *rados.IOContext, oid, name, cookie string, lock func(flags *byte) (int, error)) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				flags := lockFlagRenew
+				lock(&flags)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		// A renewal after the unlock would take the lock again.
+		<-stopped
+		ioctx.Unlock(oid, name, cookie)
+	}
+}
+
+// A lock held on an ORFS object, as listed by ListLocks.
+type LockHolder struct {
+	// Pool and object the lock is on.
+	Pool   string
+	Object string
+	// Name of the lock, AddEntry, Lease or Journal.
+	Name      string
+	Exclusive bool
+	// RADOS client holding the lock and its address.
+	Client string
+	Cookie string
+	Addr   string
+}
+
+// Lists the locks held on the objects in the metadata and data pools. RADOS
+// doesn't report when a lock expires, locks taken by older clients never
+// do, so a lock which stays listed while its client is gone is stale and
+// can be broken with BreakLock. This reads every object of both pools.
+func (fs *Orfs) ListLocks() ([]LockHolder, error) {
+	var ret []LockHolder
+	pools := []struct {
+		name string
+		md   bool
+	}{{fs.mdpool, true}, {fs.pool, false}}
+	for i, p := range pools {
+		if i > 0 && p.name == pools[0].name {
+			break
+		}
+		path := p.name
+		err := fs.call(p.md, func(ioctx *rados.IOContext) error {
+			var oids []string
+			if err := ioctx.ListObjects(func(oid string) {
+				oids = append(oids, oid)
+			}); err != nil {
+				return err
+			}
+			for _, oid := range oids {
+				path = p.name + "/" + oid
+				for _, name := range lockNames {
+					info, err := ioctx.ListLockers(oid, name)
+					if err == rados.RadosErrorNotFound {
+						break
+					} else if err != nil {
+						return err
+					}
+					for n := 0; n < info.NumLockers; n++ {
+						ret = append(ret, LockHolder{
+							Pool:      p.name,
+							Object:    oid,
+							Name:      name,
+							Exclusive: info.Exclusive,
+							Client:    info.Clients[n],
+							Cookie:    info.Cookies[n],
+							Addr:      info.Addrs[n],
+						})
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			pathError("listlocks", path, &err)
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Breaks a lock listed by ListLocks. The client holding it isn't told, it
+// must be gone or it may go on as if it still held the lock.
+func (fs *Orfs) BreakLock(l LockHolder) (err error) {
+	defer pathError("breaklock", l.Pool+"/"+l.Object, &err)
+	fs.logger.Info("Breaking lock", "lock", l.Name, "pool", l.Pool, "object", l.Object, "client", l.Client, "cookie", l.Cookie)
+	var ret int
+	err = fs.call(l.Pool == fs.mdpool, func(ioctx *rados.IOContext) (err error) {
+		ret, err = ioctx.BreakLock(l.Object, l.Name, l.Client, l.Cookie)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		return rados.RadosError(ret)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package orfs
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Every Orfs logs to its own slog.Logger, records carry the pools of the
+// instance and, where they apply, the op, path and inode. Public operations
+// log a record with their latency when they return, at debug level, failures
+// other than missing or existing files and denied access at warn level.
+
+// SetLogger sets the logger of this instance, nil discards the logs, which is
+// the default.
+func (fs *Orfs) SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+	fs.logger = l.With("pool", fs.pool, "mdpool", fs.mdpool)
+}
+
+// Sets a text log output of info and higher levels.
+//
+// Deprecated: use SetLogger.
+func (fs *Orfs) SetLog(w io.Writer) {
+	fs.SetLogger(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelInfo})))
+}
+
+// Sets a text log output of all levels.
+//
+// Deprecated: use SetLogger.
+func (fs *Orfs) SetDebugLog(w io.Writer) {
+	fs.SetLogger(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})))
+}
+
+// startOp starts op in a span of its own. The returned function ends the
+// span, logs op with its latency and the error it returned and records it in
+// the metrics. If op failed because the connection was lost it is replaced in
+// the background. ctx is replaced by the context of the span and the function
+// deferred with the named error result:
+//
+//	ctx, end := fs.startOp(ctx, "Mkdir", slog.String("path", name))
+//	defer end(&err)
+func (fs *Orfs) startOp(ctx context.Context, op string, attrs ...slog.Attr) (context.Context, func(*error)) {
+	start := time.Now()
+	fs.connMu.RLock()
+	gen := fs.connGen
+	fs.connMu.RUnlock()
+	ctx, span := fs.tracer.Start(ctx, op, trace.WithAttributes(spanAttrs(attrs)...),
+		trace.WithAttributes(attribute.String("orfs.pool", fs.pool), attribute.String("orfs.mdpool", fs.mdpool)))
+	return ctx, func(err *error) {
+		if connLost(*err) {
+			go fs.reconnect(fs.bg, gen)
+		}
+		endSpan(span, *err)
+		fs.metrics.observeOp(op, start, *err)
+		level := slog.LevelDebug
+		if *err != nil && !expectedError(*err) {
+			level = slog.LevelWarn
+		}
+		if !fs.logger.Enabled(ctx, level) {
+			return
+		}
+		attrs = append(attrs, slog.String("op", op), slog.Duration("latency", time.Since(start)))
+		if *err != nil {
+			attrs = append(attrs, slog.Any("error", *err))
+		}
+		fs.logger.LogAttrs(ctx, level, op, attrs...)
+	}
+}
+
+// Errors callers run into in normal use, not worth a warning.
+func expectedError(err error) bool {
+	return err == io.EOF || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) || errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.ENODATA)
+}
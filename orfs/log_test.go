@@ -0,0 +1,43 @@
+package orfs
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSetLogPerInstance(t *testing.T) {
+	a, _ := NewORFS("a", "a", 10)
+	b, _ := NewORFS("b", "b", 10)
+	var bufA, bufB bytes.Buffer
+	a.SetDebugLog(&bufA)
+	b.SetDebugLog(&bufB)
+	a.logger.Debug("test")
+	if !strings.Contains(bufA.String(), "pool=a") || bufB.Len() != 0 {
+		t.Fatalf("SetDebugLog changed the log of another instance, a: %q, b: %q", bufA.String(), bufB.String())
+	}
+}
+
+func TestStartOp(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	var buf bytes.Buffer
+	fs.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	err := os.ErrNotExist
+	_, end := fs.startOp(context.Background(), "Stat", slog.String("path", "/a"))
+	end(&err)
+	if buf.Len() != 0 {
+		t.Fatalf("expected error logged above debug level: %q", buf.String())
+	}
+	err = syscall.EIO
+	_, end = fs.startOp(context.Background(), "Stat", slog.String("path", "/a"))
+	end(&err)
+	for _, want := range []string{"level=WARN", "op=Stat", "path=/a", "latency=", "pool=a"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q lacks %v", buf.String(), want)
+		}
+	}
+}
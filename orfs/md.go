@@ -1,6 +1,8 @@
 package orfs
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/google/uuid"
@@ -10,9 +12,9 @@ import (
 	"time"
 )
 
-var MdEntryTooShort = fmt.Errorf("Metadata entry too short")
+var MdEntryTooShort error = corruptError("Metadata entry too short")
 var MdEntryEmpty = fmt.Errorf("Metadata entry empty")
-var MdEntryInvalid = fmt.Errorf("Metadata entry is invalid")
+var MdEntryInvalid error = corruptError("Metadata entry is invalid")
 
 func makeMdEntryNewline(state byte, f OrfsStat) []byte {
 	//ret := makeMdEntry(state, f)
@@ -22,16 +24,30 @@ func makeMdEntryNewline(state byte, f OrfsStat) []byte {
 }
 
 func AddMDEntry(mdctx *rados.IOContext, DirInode uuid.UUID, action byte, obj OrfsStat) error {
-	_, err := mdctx.LockExclusive(DirInode.String(), "AddEntry", obj.Inode().String(), "Lock for entry addition", 0, nil)
+	return AppendMDEntries(mdctx, DirInode, obj.Inode().String(), makeMdEntryNewline(action, obj))
+}
+
+// Appends one or more encoded entries to a directory in a single write so
+// that either all or none of them are applied.
+func AppendMDEntries(mdctx *rados.IOContext, DirInode uuid.UUID, cookie string, entries []byte) error {
+	return appendMDEntries(context.Background(), nil, mdctx, DirInode, cookie, entries)
+}
+
+// appendMDEntries is AppendMDEntries recording the append in m.
+func appendMDEntries(ctx context.Context, m *Metrics, mdctx *rados.IOContext, DirInode uuid.UUID, cookie string, entries []byte) (err error) {
+	defer func(start time.Time) {
+		m.observeOp("AddMDEntry", start, err)
+	}(time.Now())
+	unlock, err := lockExclusive(ctx, m, mdctx, DirInode.String(), "AddEntry", cookie, "Lock for entry addition")
 	if err != nil {
 		return err
 	}
-	defer mdctx.Unlock(DirInode.String(), "AddEntry", obj.Inode().String())
-	fmt.Printf("Adding obj to metadata: %v\n", obj)
-	err = mdctx.Append(DirInode.String(), makeMdEntryNewline(action, obj))
+	defer unlock()
+	err = mdctx.Append(DirInode.String(), entries)
 	if err != nil {
 		return err
 	}
+	m.transferred(true, "write", len(entries))
 	return nil
 }
 
@@ -41,6 +57,8 @@ func makeMdEntry(state byte, f OrfsStat) []byte {
 	entry = append(entry, state)
 	if f.IsDir() {
 		entry = append(entry, 'd')
+	} else if f.Mode()&os.ModeSymlink != 0 {
+		entry = append(entry, 'l')
 	} else {
 		entry = append(entry, 'f')
 	}
@@ -59,6 +77,24 @@ func makeMdEntry(state byte, f OrfsStat) []byte {
 	// Add inode (uuid)
 	entry = append(entry, ';')
 	entry = append(entry, uuid.UUID(f.Inode()).String()...)
+	// Optional fields follow the inode, older entries may lack them.
+	// Encode f.Nlink() (uint64)
+	entry = append(entry, ';')
+	entry = append(entry, []byte(strconv.FormatUint(f.Nlink(), 10))...)
+	// Symlinks store the length of the target followed by the target
+	if f.Mode()&os.ModeSymlink != 0 {
+		entry = append(entry, ';')
+		entry = append(entry, []byte(strconv.FormatUint(uint64(len(f.LinkTarget())), 10))...)
+		entry = append(entry, ';')
+		entry = append(entry, []byte(f.LinkTarget())...)
+	}
+	// Encode the permission bits as octal, followed by uid and gid
+	entry = append(entry, ';')
+	entry = append(entry, []byte(strconv.FormatUint(uint64(posixMode(f.Mode())), 8))...)
+	entry = append(entry, ';')
+	entry = append(entry, []byte(strconv.FormatUint(uint64(f.Uid()), 10))...)
+	entry = append(entry, ';')
+	entry = append(entry, []byte(strconv.FormatUint(uint64(f.Gid()), 10))...)
 
 	// Calculate checksum and write it out.
 	crc := crc16.ChecksumCCITT(entry)
@@ -67,15 +103,6 @@ func makeMdEntry(state byte, f OrfsStat) []byte {
 	return entry
 }
 
-func findNext(p []byte, del byte, start int) int {
-	for i := start; i < len(p); i++ {
-		if p[i] == del {
-			return start + i
-		}
-	}
-	return -1
-}
-
 func parseMdEntry(entry []byte) (byte, OrfsStat, error) {
 	// Check if entry is empty
 	if len(entry) == 0 {
@@ -85,79 +112,126 @@ func parseMdEntry(entry []byte) (byte, OrfsStat, error) {
 	if len(entry) < 12 {
 		return 0x0, nil, MdEntryTooShort
 	}
+	// The crc follows the last ';', an entry which was torn or corrupted
+	// fails it.
+	crcPos := bytes.LastIndexByte(entry, ';')
+	if crcPos < 0 {
+		return 0x0, nil, MdEntryInvalid
+	}
+	crc, err := strconv.ParseUint(string(entry[crcPos+1:]), 16, 16)
+	if err != nil || uint16(crc) != crc16.ChecksumCCITT(entry[:crcPos]) {
+		return 0x0, nil, MdEntryInvalid
+	}
+	entry = entry[:crcPos]
+
+	// nextField returns the field up to the next ';', it reports false
+	// when there are no fields left.
 	pos := 0
-	etype := entry[pos:findNext(entry, ';', 0)]
-	fmt.Printf("Len etype: %v, etype: %v\n", len(etype), etype)
+	nextField := func() ([]byte, bool) {
+		if pos > len(entry) {
+			return nil, false
+		}
+		end := bytes.IndexByte(entry[pos:], ';')
+		if end < 0 {
+			end = len(entry) - pos
+		}
+		field := entry[pos : pos+end]
+		pos += end + 1
+		return field, true
+	}
+	// sizedField returns a field of n bytes, which may contain ';'.
+	sizedField := func(n []byte) ([]byte, bool) {
+		length, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil || length > uint64(len(entry)-pos) {
+			return nil, false
+		}
+		field := entry[pos : pos+int(length)]
+		pos += int(length) + 1
+		return field, true
+	}
+	number := func(base, bits int) (uint64, bool) {
+		field, ok := nextField()
+		if !ok {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(string(field), base, bits)
+		return n, err == nil
+	}
+
+	etype, _ := nextField()
 	if len(etype) != 2 {
-		panic(MdEntryInvalid)
 		return 0x0, nil, MdEntryInvalid
 	}
-	pos += len(etype) + 1
 	state := etype[0]
 	isDir := etype[1] == 'd'
-	fmt.Printf("ParseMDEntry, is dir: %v\n", isDir)
+	isSymlink := etype[1] == 'l'
 
-	// read out filename length
-	nLengthBytes := entry[pos : findNext(entry, ';', pos)-pos]
-	nLength, err := strconv.ParseUint(string(nLengthBytes), 10, 64)
-	if err != nil {
-		fmt.Printf("nlength bytes: %v, string: %v, err: %v\n", nLengthBytes, string(nLengthBytes), err)
-		panic(MdEntryInvalid)
+	nLength, _ := nextField()
+	fName, ok := sizedField(nLength)
+	if !ok {
 		return 0x0, nil, MdEntryInvalid
 	}
-	pos += len(nLengthBytes) + 1
-	// Read filename of length
-	fName := entry[pos : uint64(pos)+nLength]
-	pos += len(fName) + 1
-
-	// Read out filesize
-	fsizeBytes := entry[pos : findNext(entry, ';', pos)-pos]
-	fsize, err := strconv.ParseUint(string(fsizeBytes), 10, 64)
-	if err != nil {
-		fmt.Printf("fsizeBytes bytes: %v, string: %v, err: %v\n", fsizeBytes, string(fsizeBytes), err)
-		panic(MdEntryInvalid)
+	fsize, ok := number(10, 64)
+	if !ok {
 		return 0x0, nil, MdEntryInvalid
 	}
-	pos += len(fsizeBytes) + 1
-
-	// Read out modtime
-	modTimeBytes := entry[pos : findNext(entry, ';', pos)-pos]
-	modTime, err := strconv.ParseUint(string(modTimeBytes), 10, 64)
-	if err != nil {
-		panic(MdEntryInvalid)
+	modTime, ok := number(10, 64)
+	if !ok {
 		return 0x0, nil, MdEntryInvalid
 	}
-	pos += len(modTimeBytes) + 1
-
-	// Read out file inode (uuid)
-	inode, err := uuid.Parse(string(entry[pos : pos+36]))
-	if err != nil {
-		return 0x0, nil, err
-	}
-	pos += 36 + 1
-
-	// Read out crc
-	crcBytes := entry[pos:]
-	crc, err := strconv.ParseUint(string(crcBytes), 16, 16)
-	if err != nil {
-		fmt.Printf("crcBytes: %v, string: %v, err: %v\n", crcBytes, string(crcBytes), err)
-		panic(MdEntryInvalid)
+	field, _ := nextField()
+	inode, err := uuid.Parse(string(field))
+	if err != nil || len(field) != 36 {
 		return 0x0, nil, MdEntryInvalid
 	}
 
-	// Calculate crc
-	crcCalc := crc16.ChecksumCCITT(entry[0 : pos-1])
-	if uint16(crc) != crcCalc {
-		panic(MdEntryInvalid)
-		return 0x0, nil, MdEntryInvalid
+	// The optional fields follow, older entries may lack them.
+	nlink := uint64(1)
+	if pos <= len(entry) {
+		if nlink, ok = number(10, 64); !ok {
+			return 0x0, nil, MdEntryInvalid
+		}
+	}
+	var target string
+	if isSymlink {
+		tLength, _ := nextField()
+		field, ok := sizedField(tLength)
+		if !ok {
+			return 0x0, nil, MdEntryInvalid
+		}
+		target = string(field)
+	}
+	var perm *os.FileMode
+	if pos <= len(entry) {
+		mode, ok := number(8, 32)
+		if !ok {
+			return 0x0, nil, MdEntryInvalid
+		}
+		m := modeFromPosix(uint32(mode))
+		perm = &m
+	}
+	var ids [2]uint32
+	for i := range ids {
+		if pos <= len(entry) {
+			id, ok := number(10, 32)
+			if !ok {
+				return 0x0, nil, MdEntryInvalid
+			}
+			ids[i] = uint32(id)
+		}
 	}
 
 	fileMode := os.FileMode(0000)
 	if isDir {
 		fileMode = os.FileMode(0755) | os.ModeDir
+	} else if isSymlink {
+		fileMode = os.FileMode(0777) | os.ModeSymlink
 	} else {
 		fileMode = os.FileMode(0644)
 	}
+	if perm != nil {
+		fileMode = fileMode&os.ModeType | *perm
+	}
 
 	f := Istat{
 		name:    string(fName),
@@ -165,10 +239,13 @@ func parseMdEntry(entry []byte) (byte, OrfsStat, error) {
 		modTime: time.Unix(int64(modTime), 0),
 		mode:    fileMode,
 		size:    int64(fsize),
+		nlink:   nlink,
+		target:  target,
+		uid:     ids[0],
+		gid:     ids[1],
 		sys:     nil,
 	}
 	copy(f.inode[:], inode[:16])
-	fmt.Printf("ParseMDEntry, Stat isdir: %v\n", f.IsDir())
 	return state, &f, nil
 
 }
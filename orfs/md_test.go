@@ -0,0 +1,71 @@
+package orfs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/howeyc/crc16"
+	"os"
+	"testing"
+	"time"
+)
+
+var testInode = uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+
+func TestMdEntryRoundTrip(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+	for _, s := range []*Istat{
+		{name: "file", size: 4096, mode: 0644, nlink: 1},
+		{name: "dir", mode: 0755 | os.ModeDir, isDir: true, nlink: 1},
+		{name: "a;b", size: 1, mode: 0600, nlink: 3, uid: 1000, gid: 100},
+		{name: "link", mode: 0777 | os.ModeSymlink, nlink: 1, target: "../x;y"},
+		{name: "suid", mode: 0755 | os.ModeSetuid | os.ModeSetgid, nlink: 1},
+		{name: "tmp", mode: 0777 | os.ModeDir | os.ModeSticky, isDir: true, nlink: 1},
+	} {
+		s.modTime, s.inode = modTime, testInode
+		entry := makeMdEntry('+', s)
+		state, got, err := parseMdEntry(entry)
+		if err != nil {
+			t.Errorf("parseMdEntry(%q): %v", entry, err)
+			continue
+		}
+		if state != '+' || *got.(*Istat) != *s {
+			t.Errorf("parseMdEntry(%q) = %c %+v, want %+v", entry, state, got, s)
+		}
+	}
+}
+
+func TestMdEntryOldFormat(t *testing.T) {
+	// Entries written before nlink, symlinks and permissions were stored.
+	entry := []byte("+f;4;name;10;1500000000;" + testInode.String())
+	entry = append(entry, fmt.Sprintf(";%x", crc16.ChecksumCCITT(entry))...)
+	_, s, err := parseMdEntry(entry)
+	if err != nil {
+		t.Fatalf("parseMdEntry(%q): %v", entry, err)
+	}
+	if s.Name() != "name" || s.Size() != 10 || s.Nlink() != 1 || s.Mode() != 0644 {
+		t.Fatalf("parseMdEntry(%q) = %+v", entry, s)
+	}
+}
+
+func TestMdEntryCorrupt(t *testing.T) {
+	s := &Istat{name: "link", mode: 0777 | os.ModeSymlink, nlink: 2, target: "target", modTime: time.Unix(1, 0), inode: testInode}
+	entry := makeMdEntry('+', s)
+	// Every torn entry is rejected without a panic.
+	for n := 1; n < len(entry); n++ {
+		_, _, err := parseMdEntry(entry[:n])
+		if err == nil {
+			t.Errorf("parseMdEntry(%q) accepted", entry[:n])
+		} else if n >= 12 && !errors.Is(err, ErrCorruptMetadata) {
+			t.Errorf("parseMdEntry(%q) = %v, want ErrCorruptMetadata", entry[:n], err)
+		}
+	}
+	flipped := append([]byte{}, entry...)
+	flipped[5] ^= 1
+	if _, _, err := parseMdEntry(flipped); !errors.Is(err, ErrCorruptMetadata) {
+		t.Errorf("parseMdEntry(%q) = %v, want ErrCorruptMetadata", flipped, err)
+	}
+	if _, _, err := parseMdEntry(nil); err != MdEntryEmpty {
+		t.Errorf("parseMdEntry of an empty line = %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package orfs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Metrics collects the metrics of one Orfs, see EnableMetrics. A nil
+// *Metrics records nothing, so instances without metrics pay nothing.
+type Metrics struct {
+	ops         *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	cache       *prometheus.CounterVec
+	lockWait    *prometheus.HistogramVec
+	lockRetries *prometheus.CounterVec
+	lockTimeout *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+	// Pools of the instance, bytes are counted by pool.
+	pool, mdpool string
+}
+
+func newMetrics(pool, mdpool string) *Metrics {
+	return &Metrics{
+		pool:   pool,
+		mdpool: mdpool,
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "orfs",
+			Name:      "operations_total",
+			Help:      "Operations by op and result, ok or error.",
+		}, []string{"op", "result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "orfs",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of operations by op.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"op"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "orfs",
+			Name:      "cache_events_total",
+			Help:      "Inode cache lookups and evictions, by event hit, miss or eviction.",
+		}, []string{"event"}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "orfs",
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent taking RADOS locks, whether or not they were taken, by lock name.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"lock"}),
+		lockRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "orfs",
+			Name:      "lock_retries_total",
+			Help:      "Attempts to take a RADOS lock which found it busy, by lock name.",
+		}, []string{"lock"}),
+		lockTimeout: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "orfs",
+			Name:      "lock_timeouts_total",
+			Help:      "Waits for a RADOS lock which gave up while it was still busy, by lock name.",
+		}, []string{"lock"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "orfs",
+			Name:      "bytes_total",
+			Help:      "Bytes read from and written to RADOS, by pool and direction.",
+		}, []string{"pool", "direction"}),
+	}
+}
+
+// EnableMetrics starts collecting metrics and returns the collector to
+// register. Like SetLogger it must be called before the Orfs is shared. The
+// metrics of several instances in one registry need telling apart, for
+// example with prometheus.WrapRegistererWith.
+func (fs *Orfs) EnableMetrics() *Metrics {
+	if fs.metrics == nil {
+		fs.metrics = newMetrics(fs.pool, fs.mdpool)
+	}
+	return fs.metrics
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.ops, m.latency, m.cache, m.lockWait, m.lockRetries, m.lockTimeout, m.bytes}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// Handler serves the metrics of this instance alone in the Prometheus text
+// format, for servers which don't have a registry of their own.
+func (m *Metrics) Handler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// serveMetrics serves the metrics at /metrics on cfg.MetricsAddr until
+// Close.
+func (fs *Orfs) serveMetrics() error {
+	ln, err := net.Listen("tcp", fs.cfg.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", fs.EnableMetrics().Handler())
+	fs.metricsServer = &http.Server{Handler: mux}
+	go fs.metricsServer.Serve(ln)
+	fs.logger.Info("Serving metrics", "addr", ln.Addr())
+	return nil
+}
+
+func (m *Metrics) observeOp(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.ops.WithLabelValues(op, result).Inc()
+	m.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) cacheEvent(event string) {
+	if m == nil {
+		return
+	}
+	m.cache.WithLabelValues(event).Inc()
+}
+
+// lockWaited records a wait for the lock name which ended with err, after
+// retries busy attempts.
+func (m *Metrics) lockWaited(name string, start time.Time, retries int, err error) {
+	if m == nil {
+		return
+	}
+	m.lockWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if retries > 0 {
+		m.lockRetries.WithLabelValues(name).Add(float64(retries))
+	}
+	if err == syscall.EBUSY {
+		m.lockTimeout.WithLabelValues(name).Inc()
+	}
+}
+
+// transferred counts n bytes read or written, in the metadata pool if md is
+// set.
+func (m *Metrics) transferred(md bool, direction string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	pool := m.pool
+	if md {
+		pool = m.mdpool
+	}
+	m.bytes.WithLabelValues(pool, direction).Add(float64(n))
+}
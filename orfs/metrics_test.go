@@ -0,0 +1,26 @@
+package orfs
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLockWaitMetrics(t *testing.T) {
+	m := newMetrics("a", "a")
+	start := time.Now()
+	m.lockWaited("AddEntry", start, 0, nil)
+	m.lockWaited("AddEntry", start, 3, syscall.EBUSY)
+	m.lockWaited("AddEntry", start, 1, context.Canceled)
+	if n := testutil.CollectAndCount(m.lockWait); n != 1 {
+		t.Errorf("%v lock wait series, want 1", n)
+	}
+	if n := testutil.ToFloat64(m.lockRetries.WithLabelValues("AddEntry")); n != 4 {
+		t.Errorf("%v lock retries, want 4", n)
+	}
+	if n := testutil.ToFloat64(m.lockTimeout.WithLabelValues("AddEntry")); n != 1 {
+		t.Errorf("%v lock timeouts, want 1", n)
+	}
+}
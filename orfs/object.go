@@ -1,11 +1,12 @@
 package orfs
 
 import (
+	"context"
 	"fmt"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/google/uuid"
+	"log/slog"
 	"os"
-	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,12 @@ type OBJ interface {
 	ModTime() time.Time
 	IsDir() bool
 	Inode() uuid.UUID
+	Nlink() uint64
+	LinkTarget() string
+	Uid() uint32
+	Gid() uint32
+	SetAttr(func(*Attr)) error
+	AddLink(int) error
 	Sys() interface{}
 	Open() (*File, error)
 	Unlink(OBJ) error
@@ -26,10 +33,16 @@ type OBJ interface {
 	List() ([]OBJ, error)
 	Add(OBJ) error
 	Delete(OBJ) error
+	Update(rm, add []OrfsStat) error
 	HasChild(string) bool
 	Get(string) (OBJ, error)
 	ReadMD() error
 	ReSync() error
+	Truncate(int64) error
+	SetXattr(attr string, value []byte, flags int) error
+	GetXattr(attr string) ([]byte, error)
+	ListXattr() ([]string, error)
+	RemoveXattr(attr string) error
 }
 
 type fsObj struct {
@@ -39,23 +52,72 @@ type fsObj struct {
 	modTime  time.Time
 	isDir    bool
 	inode    uuid.UUID
+	nlink    uint64
+	target   string
+	uid      uint32
+	gid      uint32
 	lastRead time.Time
-	children map[string]uuid.UUID
-	fs       *Orfs
+	lastSize uint64
+	// Number of records in the inode object when it was last read.
+	records int
+	// Set when writes changed size or modTime since the last inode record,
+	// re-reading the inode then keeps the larger size and later modTime.
+	dirty bool
+	// Set while the directory is watched and no notify has been received
+	// since it was read, ReadMD then has nothing to do.
+	coherent bool
+	// POSIX ACLs, loaded from the inode xattrs on first use.
+	acl        ACL
+	defaultACL ACL
+	aclLoaded  bool
+	children   map[string]uuid.UUID
+	fs         *Orfs
 	sync.RWMutex
 }
 
 /* FIXME: THIS SHOULDN'T CREATE AN INODE IMMEDIATELY!*/
 func NewObj(fs *Orfs, Name string, isDir bool) (OBJ, error) {
-	_uuid := uuid.New()
-	ctx := fs.mdctx
+	mode := os.FileMode(0644)
+	if isDir {
+		mode = os.FileMode(0755) | os.ModeDir
+	}
+	return newObj(context.Background(), fs, Superuser, nil, Name, mode, "")
+}
+
+// Creates a new symlink inode pointing to target.
+func NewSymlink(fs *Orfs, Name string, target string) (OBJ, error) {
+	return newObj(context.Background(), fs, Superuser, nil, Name, os.FileMode(0777)|os.ModeSymlink, target)
+}
 
-	if !isDir {
-		// Is not directory, write data elsewhere.
-		ctx = fs.ioctx
+// newObj creates an inode owned by c. If parent is set the new inode
+// inherits the group of a setgid parent and the default ACL of the parent.
+func newObj(ctx context.Context, fs *Orfs, c *Caller, parent OBJ, Name string, mode os.FileMode, target string) (OBJ, error) {
+	if c == nil {
+		c = Superuser
 	}
+	uid, gid := c.Uid, c.Gid
+	var acl, defaultACL ACL
+	if parent != nil {
+		if parent.Mode()&os.ModeSetgid != 0 {
+			gid = parent.Gid()
+			if mode.IsDir() {
+				mode |= os.ModeSetgid
+			}
+		}
+		var err error
+		if mode&os.ModeSymlink == 0 {
+			if mode, acl, defaultACL, err = inheritACLs(parent, mode); err != nil {
+				return nil, err
+			}
+		}
+	}
+	isDir := mode.IsDir()
+	_uuid := uuid.New()
 	for {
-		_, err := ctx.Stat(_uuid.String())
+		err := fs.call(isDir, func(ioctx *rados.IOContext) error {
+			_, err := ioctx.Stat(_uuid.String())
+			return err
+		})
 		if err == nil {
 			// UUID already exists
 			_uuid = uuid.New()
@@ -64,10 +126,8 @@ func NewObj(fs *Orfs, Name string, isDir bool) (OBJ, error) {
 		break
 	}
 
-	mode := os.FileMode(0644)
 	var children map[string]uuid.UUID
 	if isDir {
-		mode = os.FileMode(0755) | os.ModeDir
 		children = make(map[string]uuid.UUID)
 	}
 
@@ -78,22 +138,39 @@ func NewObj(fs *Orfs, Name string, isDir bool) (OBJ, error) {
 		modTime:  time.Now(),
 		isDir:    isDir,
 		inode:    _uuid,
+		nlink:    1,
+		target:   target,
+		uid:      uid,
+		gid:      gid,
 		fs:       fs,
 		children: children,
 	}
 
-	err := obj.ReSync()
+	err := obj.reSync(ctx)
 	if err != nil {
 		return nil, err
 	}
+	for attr, a := range map[string]ACL{XattrACLAccess: acl, XattrACLDefault: defaultACL} {
+		if a != nil {
+			err := obj.xattrCall(ctx, "rados.SetXattr", func(ioctx *rados.IOContext) error {
+				return ioctx.SetXattr(obj.Inode().String(), xattrPrefix+attr, a.Bytes())
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	obj.acl, obj.defaultACL, obj.aclLoaded = acl, defaultACL, true
 
 	return &obj, nil
 }
 
 func GetObjInode(fs *Orfs, Inode uuid.UUID) (OBJ, error) {
 	_obj, ok := fs.cache.Get(Inode)
-	if !ok {
-		fmt.Printf("GetObjInode, Not in cache: %v\n", Inode)
+	if ok {
+		fs.metrics.cacheEvent("hit")
+	} else {
+		fs.metrics.cacheEvent("miss")
 		_obj = &fsObj{
 			inode:    Inode,
 			fs:       fs,
@@ -102,13 +179,9 @@ func GetObjInode(fs *Orfs, Inode uuid.UUID) (OBJ, error) {
 	}
 	obj, ok := _obj.(OBJ)
 	if !ok {
-		fmt.Printf("Typeof cache obj: %v\n", reflect.TypeOf(_obj))
-		fmt.Printf("%+v\n", _obj)
-		panic("Not of type fsObj")
+		panic(fmt.Sprintf("cache holds a %T, not an OBJ", _obj))
 	}
 
-	fmt.Printf("GetObjInode: %v\n", obj.Inode())
-
 	err := obj.ReadMD()
 	if err != nil {
 		return nil, err
@@ -117,41 +190,253 @@ func GetObjInode(fs *Orfs, Inode uuid.UUID) (OBJ, error) {
 	return obj, nil
 }
 
+// getInode loads an inode when it's known whether it is a directory, which
+// is needed to find the pool of an inode that isn't cached.
+func getInode(fs *Orfs, Inode uuid.UUID, isDir bool) (OBJ, error) {
+	if _, ok := fs.cache.Get(Inode); ok {
+		return GetObjInode(fs, Inode)
+	}
+	obj := &fsObj{
+		inode:    Inode,
+		isDir:    isDir,
+		fs:       fs,
+		children: make(map[string]uuid.UUID),
+	}
+	if err := obj.ReadMD(); err != nil {
+		return nil, err
+	}
+	return fs.cacheObj(obj), nil
+}
+
+// cacheObj caches obj unless its inode is cached already and returns the
+// cached object. An object in the cache may be used by open Files and
+// lookups, it is never replaced, so they all share one object per inode.
+func (fs *Orfs) cacheObj(obj OBJ) OBJ {
+	if cached, _ := fs.cache.ContainsOrAdd(obj.Inode(), obj); cached {
+		if o, ok := fs.cache.Peek(obj.Inode()); ok {
+			return o.(OBJ)
+		}
+	}
+	return obj
+}
+
 func (f *fsObj) Name() string {
+	f.RLock()
+	defer f.RUnlock()
 	return f.name
 }
 
 func (f *fsObj) Rename(name string) {
+	f.Lock()
+	defer f.Unlock()
 	f.name = name
 }
 
 func (f *fsObj) Size() int64 {
+	f.RLock()
+	defer f.RUnlock()
 	return f.size
 }
 
 func (f *fsObj) Mode() os.FileMode {
+	f.RLock()
+	defer f.RUnlock()
 	return f.mode
 }
 
 func (f *fsObj) ModTime() time.Time {
+	f.RLock()
+	defer f.RUnlock()
 	return f.modTime
 }
 
 func (f *fsObj) IsDir() bool {
+	f.RLock()
+	defer f.RUnlock()
 	return f.isDir
 }
 
+// The inode number never changes, it is read without the lock.
 func (f *fsObj) Inode() uuid.UUID {
 	return f.inode
 }
 
+// statLocked returns a copy of the attributes, the caller holds the lock.
+func (f *fsObj) statLocked() OrfsStat {
+	return &Istat{
+		name:    f.name,
+		size:    f.size,
+		mode:    f.mode,
+		modTime: f.modTime,
+		isDir:   f.isDir,
+		nlink:   f.nlink,
+		target:  f.target,
+		uid:     f.uid,
+		gid:     f.gid,
+		inode:   f.inode,
+	}
+}
+
+func (f *fsObj) Nlink() uint64 {
+	f.RLock()
+	defer f.RUnlock()
+	return f.nlink
+}
+
+func (f *fsObj) LinkTarget() string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.target
+}
+
+func (f *fsObj) Uid() uint32 {
+	f.RLock()
+	defer f.RUnlock()
+	return f.uid
+}
+
+func (f *fsObj) Gid() uint32 {
+	f.RLock()
+	defer f.RUnlock()
+	return f.gid
+}
+
+// Changes the attributes of the inode, change is called with the current
+// attributes while the inode is locked.
+func (f *fsObj) SetAttr(change func(*Attr)) error {
+	return f.setAttr(context.Background(), change)
+}
+
+// setAttrContext is SetAttr with a context.
+func setAttrContext(ctx context.Context, obj OBJ, change func(*Attr)) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.setAttr(ctx, change)
+	}
+	return obj.SetAttr(change)
+}
+
+func (f *fsObj) setAttr(ctx context.Context, change func(*Attr)) error {
+	return f.modifyInode(ctx, func() {
+		a := Attr{Mode: f.mode, Uid: f.uid, Gid: f.gid, ModTime: f.modTime}
+		change(&a)
+		f.mode = f.mode&os.ModeType | a.Mode&^os.ModeType
+		f.uid = a.Uid
+		f.gid = a.Gid
+		f.modTime = a.ModTime
+	})
+}
+
+// Changes the link count of the inode by delta, the inode and its data are
+// freed when the last link is dropped.
+func (f *fsObj) AddLink(delta int) error {
+	return f.addLink(context.Background(), delta)
+}
+
+// addLinkContext is AddLink with a context.
+func addLinkContext(ctx context.Context, obj OBJ, delta int) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.addLink(ctx, delta)
+	}
+	return obj.AddLink(delta)
+}
+
+func (f *fsObj) addLink(ctx context.Context, delta int) error {
+	err := f.modifyInode(ctx, func() {
+		if delta < 0 && uint64(-delta) > f.nlink {
+			f.nlink = 0
+		} else {
+			f.nlink = uint64(int64(f.nlink) + int64(delta))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if f.Nlink() == 0 {
+		f.fs.cache.Remove(f.Inode())
+		return f.fDelete(ctx)
+	}
+	return nil
+}
+
+// modifyInode re-reads the inode, applies change and appends the new inode
+// record, all while holding the inode lock. ReadMD applies the records in
+// order so the last one appended wins.
+func (f *fsObj) modifyInode(ctx context.Context, change func()) error {
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		return f.appendInode(ctx, ioctx, change)
+	})
+	if err == nil {
+		f.notify(ctx, "")
+	}
+	return err
+}
+
+// appendInode applies change and appends the new inode record, the caller
+// holds the inode lock. Once inodeCompactRecords records are superseded the
+// object is rewritten instead, so reading the inode doesn't get slower with
+// every write to a file.
+func (f *fsObj) appendInode(ctx context.Context, ioctx *rados.IOContext, change func()) error {
+	f.Lock()
+	change()
+	stat := f.statLocked()
+	compact := f.records-len(f.children) >= inodeCompactRecords
+	f.Unlock()
+
+	var err error
+	if compact {
+		var md []byte
+		if md, err = f.compactMD(); err != nil {
+			return err
+		}
+		_, span := f.radosSpan(ctx, "rados.WriteFull", f.Inode().String(), stat.IsDir())
+		err = ioctx.WriteFull(f.Inode().String(), md)
+		endSpan(span, err)
+	} else {
+		_, span := f.radosSpan(ctx, "rados.Append", f.Inode().String(), stat.IsDir())
+		err = ioctx.Append(f.Inode().String(), makeMdEntryNewline('I', stat))
+		endSpan(span, err)
+	}
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	f.dirty = false
+	f.Unlock()
+	return nil
+}
+
+// Number of superseded records after which appendInode rewrites the inode.
+const inodeCompactRecords = 64
+
+// locked calls fn with the inode object locked and the in memory state
+// brought up to date with it. The lock is the same one AddMDEntry takes so
+// all appends to the object are serialized.
+func (f *fsObj) locked(ctx context.Context, fn func(ioctx *rados.IOContext) error) error {
+	return f.fs.call(f.IsDir(), func(ioctx *rados.IOContext) error {
+		cookie := uuid.New().String()
+		unlock, err := lockExclusive(ctx, f.fs.metrics, ioctx, f.Inode().String(), "AddEntry", cookie, "Lock for inode update")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// Don't trust the watch here, a notify may still be on its way.
+		f.Lock()
+		f.coherent = false
+		f.Unlock()
+		if err := f.readMD(ctx); err != nil {
+			return err
+		}
+		return fn(ioctx)
+	})
+}
+
 func (f *fsObj) Sys() interface{} {
 	return nil
 }
 
 func (f *fsObj) List() (objList []OBJ, err error) {
-	fmt.Printf("Listdir: %+v\n", f.isDir)
-	if !f.isDir {
+	if !f.IsDir() {
 		return nil, os.ErrInvalid
 	}
 	err = f.ReadMD()
@@ -159,7 +444,7 @@ func (f *fsObj) List() (objList []OBJ, err error) {
 		return nil, err
 	}
 
-	for _, v := range f.children {
+	for _, v := range f.childInodes() {
 		obj, err := GetObjInode(f.fs, v)
 		if err != nil {
 			return nil, err
@@ -170,7 +455,20 @@ func (f *fsObj) List() (objList []OBJ, err error) {
 }
 
 func (f *fsObj) Add(o OBJ) error {
-	if !f.isDir {
+	return f.add(context.Background(), o)
+}
+
+// addContext is dir.Add, waiting for the lock of dir no longer than ctx
+// allows and tracing the append in the span of ctx.
+func addContext(ctx context.Context, dir, o OBJ) error {
+	if d, ok := dir.(*fsObj); ok {
+		return d.add(ctx, o)
+	}
+	return dir.Add(o)
+}
+
+func (f *fsObj) add(ctx context.Context, o OBJ) error {
+	if !f.IsDir() {
 		return os.ErrNotExist
 	}
 
@@ -178,158 +476,351 @@ func (f *fsObj) Add(o OBJ) error {
 		return os.ErrInvalid
 	}
 
-	if _, ok := f.children[o.Name()]; ok {
-		return os.ErrExist
-	}
-	// Lock dir
+	// Lock dir, the existence check is done against the directory as it
+	// is on disk so that only one of several racing creators wins.
 	// Add inode to disk
 	// Unlock dir
-	f.Lock()
-	defer f.Unlock()
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		f.Lock()
+		defer f.Unlock()
 
-	err := o.ReSync()
-	if err != nil {
-		return err
+		if err := f.checkUpdate(nil, []OrfsStat{o}); err != nil {
+			return err
+		}
+
+		err := reSyncContext(ctx, o)
+		if err != nil {
+			return err
+		}
+
+		entry := makeMdEntryNewline('+', o)
+		start := time.Now()
+		_, span := f.radosSpan(ctx, "rados.Append", f.Inode().String(), true)
+		err = ioctx.Append(f.Inode().String(), entry)
+		endSpan(span, err)
+		f.fs.metrics.observeOp("AddMDEntry", start, err)
+		if err != nil {
+			return err
+		}
+		f.fs.metrics.transferred(true, "write", len(entry))
+
+		f.applyUpdate(nil, []OrfsStat{o})
+		return nil
+	})
+	if err == nil {
+		f.notify(ctx, o.Name())
 	}
+	return err
+}
 
-	err = AddMDEntry(f.fs.mdctx, f.Inode(), '+', o)
-	if err != nil {
-		return err
+func (f *fsObj) Unlink(o OBJ) error {
+	return f.unlink(context.Background(), o)
+}
+
+// unlink removes the entry of o with the directory locked and re-read, like
+// appendUpdate. The entry must still link o, otherwise a racing Rename or
+// unlink took it and os.ErrNotExist is returned.
+func (f *fsObj) unlink(ctx context.Context, o OBJ) error {
+	name := o.Name()
+	entry := makeMdEntryNewline('-', o)
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		f.Lock()
+		defer f.Unlock()
+		if inode, ok := f.children[name]; !ok || inode != o.Inode() {
+			return os.ErrNotExist
+		}
+		start := time.Now()
+		_, span := f.radosSpan(ctx, "rados.Append", f.Inode().String(), true)
+		err := ioctx.Append(f.Inode().String(), entry)
+		endSpan(span, err)
+		f.fs.metrics.observeOp("AddMDEntry", start, err)
+		if err != nil {
+			return err
+		}
+		f.fs.metrics.transferred(true, "write", len(entry))
+		delete(f.children, name)
+		return nil
+	})
+	if err == nil {
+		f.notify(ctx, name)
 	}
+	return err
+}
 
-	f.children[o.Name()] = o.Inode()
+// Atomically unlinks the entries in rm and links the entries in add, all
+// entries are written to the directory in a single append. Entries in add
+// which are objects are synced and cached, other stats only add a name for
+// an existing inode.
+func (f *fsObj) Update(rm, add []OrfsStat) error {
+	return f.update(context.Background(), rm, add)
+}
 
-	f.fs.cache.Add(o.Inode(), o)
+// updateContext is Update with a context.
+func updateContext(ctx context.Context, dir OBJ, rm, add []OrfsStat) error {
+	if d, ok := dir.(*fsObj); ok {
+		return d.update(ctx, rm, add)
+	}
+	return dir.Update(rm, add)
+}
 
+func (f *fsObj) update(ctx context.Context, rm, add []OrfsStat) error {
+	if !f.IsDir() {
+		return os.ErrNotExist
+	}
+	if err := f.appendUpdate(ctx, rm, add); err != nil {
+		return err
+	}
+	f.notify(ctx, "")
 	return nil
 }
 
-func (f *fsObj) Unlink(o OBJ) error {
-	f.Lock()
-	defer f.Unlock()
-	err := AddMDEntry(f.fs.mdctx, f.Inode(), '-', o)
-	if err != nil {
-		return err
+// appendUpdate writes the entries with the directory locked and re-read.
+// The names in rm must still link the inodes given and the names in add
+// must be free or in rm, otherwise a racing Link, Rename or create took them
+// and os.ErrExist is returned.
+func (f *fsObj) appendUpdate(ctx context.Context, rm, add []OrfsStat) error {
+	if len(rm)+len(add) == 0 {
+		return nil
+	}
+	return f.locked(ctx, func(ioctx *rados.IOContext) error {
+		f.Lock()
+		defer f.Unlock()
+
+		if err := f.checkUpdate(rm, add); err != nil {
+			return err
+		}
+		var entries []byte
+		for _, o := range rm {
+			entries = append(entries, makeMdEntryNewline('-', o)...)
+		}
+		for _, o := range add {
+			if obj, ok := o.(OBJ); ok {
+				if err := reSyncContext(ctx, obj); err != nil {
+					return err
+				}
+			}
+			entries = append(entries, makeMdEntryNewline('+', o)...)
+		}
+		start := time.Now()
+		_, span := f.radosSpan(ctx, "rados.Append", f.Inode().String(), true)
+		err := ioctx.Append(f.Inode().String(), entries)
+		endSpan(span, err)
+		f.fs.metrics.observeOp("AddMDEntry", start, err)
+		if err != nil {
+			return err
+		}
+		f.fs.metrics.transferred(true, "write", len(entries))
+
+		f.applyUpdate(rm, add)
+		return nil
+	})
+}
+
+// checkUpdate returns os.ErrExist unless the names in rm still link the
+// inodes given, or are gone, and the names in add are free or in rm. f must
+// be locked.
+func (f *fsObj) checkUpdate(rm, add []OrfsStat) error {
+	removed := make(map[string]bool)
+	for _, o := range rm {
+		if inode, ok := f.children[o.Name()]; ok && inode != o.Inode() {
+			return os.ErrExist
+		}
+		removed[o.Name()] = true
+	}
+	for _, o := range add {
+		if _, ok := f.children[o.Name()]; ok && !removed[o.Name()] {
+			return os.ErrExist
+		}
 	}
-	delete(f.children, o.Name())
 	return nil
 }
 
+// applyUpdate unlinks rm and links add in memory once their entries are
+// written, the objects in add are cached. f must be locked.
+func (f *fsObj) applyUpdate(rm, add []OrfsStat) {
+	for _, o := range rm {
+		delete(f.children, o.Name())
+	}
+	for _, o := range add {
+		f.children[o.Name()] = o.Inode()
+		if obj, ok := o.(OBJ); ok {
+			f.fs.cacheObj(obj)
+		}
+	}
+}
+
 func (f *fsObj) Delete(o OBJ) error {
-	if !f.isDir {
+	return f.delete(context.Background(), o)
+}
+
+func (f *fsObj) delete(ctx context.Context, o OBJ) error {
+	if !f.IsDir() {
 		return os.ErrNotExist
 	}
-	if err := f.Unlink(o); err != nil {
+	if err := f.unlink(ctx, o); err != nil {
 		return err
 	}
-	err := o.FDelete()
-	return err
+	return addLinkContext(ctx, o, -1)
 }
 
 func (f *fsObj) Open() (*File, error) {
-	fmt.Fprintf(debuglog, "Open of Inode: %v\n", f.Inode())
-	return &File{
-		Inode:  f,
-		fs:     f.fs,
-		pos:    0,
-		dInode: f.Inode().String() + ".1", // Stupidly ugly, but works to write and read data.
-	}, nil
+	f.fs.logger.Debug("Open", "inode", f.Inode())
+	file := &File{
+		Inode: f,
+		fs:    f.fs,
+		pos:   0,
+		flag:  os.O_RDWR,
+		path:  f.Name(),
+	}
+	f.fs.registerFile(file)
+	return file, nil
 }
 
+// Deletes the inode and the data of a file.
 func (f *fsObj) FDelete() error {
-	return f.fs.mdctx.Delete(f.Inode().String())
+	return f.fDelete(context.Background())
+}
+
+func (f *fsObj) fDelete(ctx context.Context) error {
+	if !f.IsDir() {
+		if err := f.deleteBlocks(ctx, 0); err != nil {
+			return err
+		}
+	}
+	_, span := f.radosSpan(ctx, "rados.Delete", f.Inode().String(), f.IsDir())
+	err := f.fs.call(f.IsDir(), func(ioctx *rados.IOContext) error {
+		return ioctx.Delete(f.Inode().String())
+	})
+	endSpan(span, err)
+	return err
 }
 
 func (f *fsObj) HasChild(Name string) bool {
+	f.RLock()
+	defer f.RUnlock()
 	_, ok := f.children[Name]
 	return ok
 }
 
-func (f *fsObj) Get(Name string) (OBJ, error) {
-	if f.Name() == Name {
-		fmt.Printf("Get of name: \"%v\", it's me, returning self\n", Name)
-		return f, nil
+// childInodes returns a copy of the inodes of the entries.
+func (f *fsObj) childInodes() []uuid.UUID {
+	f.RLock()
+	defer f.RUnlock()
+	inodes := make([]uuid.UUID, 0, len(f.children))
+	for _, v := range f.children {
+		inodes = append(inodes, v)
+	}
+	return inodes
+}
+
+// childNames returns the names of the entries.
+func (f *fsObj) childNames() []string {
+	f.RLock()
+	defer f.RUnlock()
+	names := make([]string, 0, len(f.children))
+	for name := range f.children {
+		names = append(names, name)
 	}
-	for k, v := range f.children {
-		fmt.Printf("Cache Get, children: %v: %v\n", k, v)
+	return names
+}
+
+func (f *fsObj) Get(Name string) (OBJ, error) {
+	// Cheap while the directory is watched and unchanged.
+	if err := f.ReadMD(); err != nil {
+		return nil, err
 	}
+	f.RLock()
 	Inode, ok := f.children[Name]
+	f.RUnlock()
 	if !ok {
-		fmt.Fprintf(debuglog, "Failed to find Inode for: %v in dir: %v\n", Name, f.Inode())
 		return nil, os.ErrNotExist
 	}
-	keys := f.fs.cache.Keys()
-	for _, v := range keys {
-		fmt.Printf("Cache Get, Key: %v\n", v.(uuid.UUID))
-	}
 	_obj, ok := f.fs.cache.Get(Inode)
-	if !ok {
-		fmt.Fprintf(debuglog, "Failed to get Inode %v from cache\n", Inode)
-		return nil, os.ErrNotExist
+	if ok {
+		f.fs.metrics.cacheEvent("hit")
+	} else {
+		f.fs.metrics.cacheEvent("miss")
+		// Evicted, reading the whole directory caches its entries again.
+		f.Lock()
+		f.coherent = false
+		f.lastRead = time.Time{}
+		f.Unlock()
+		if err := f.ReadMD(); err != nil {
+			return nil, err
+		}
+		if _obj, ok = f.fs.cache.Get(Inode); !ok {
+			f.fs.logger.Debug("Entry not in cache after re-reading directory", "inode", f.Inode(), "name", Name, "child", Inode)
+			return nil, os.ErrNotExist
+		}
 	}
 	return _obj.(OBJ), nil
 }
 
 func (f *fsObj) ReadMD() error {
-	buf := make([]byte, 1024*1024*4) // should make this a loop and parse stuff as i go..
-	pos := uint64(0)
+	return f.readMD(context.Background())
+}
 
-	ctx := f.fs.mdctx
+// readMDContext is ReadMD with a context.
+func readMDContext(ctx context.Context, obj OBJ) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.readMD(ctx)
+	}
+	return obj.ReadMD()
+}
 
-	if !f.IsDir() {
-		// Is not directory, write data elsewhere.
-		ctx = f.fs.ioctx
+func (f *fsObj) readMD(ctx context.Context) error {
+	f.RLock()
+	coherent := f.coherent
+	f.RUnlock()
+	if coherent {
+		return nil
 	}
-	fmt.Printf("ReadMD: f.Inode: %+v\n", f.Inode().String())
-	stat, err := ctx.Stat(f.Inode().String())
+	var stat rados.ObjectStat
+	_, span := f.radosSpan(ctx, "rados.Stat", f.Inode().String(), f.IsDir())
+	err := f.fs.retry(ctx, f.IsDir(), func(ioctx *rados.IOContext) (err error) {
+		stat, err = ioctx.Stat(f.Inode().String())
+		return err
+	})
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
 	f.Lock()
 	defer f.Unlock()
-	if !stat.ModTime.After(f.lastRead) {
+	if !stat.ModTime.After(f.lastRead) && stat.Size == f.lastSize {
 		// We already have latest version in memory
+		f.coherent = f.isDir && f.fs.watch(f.Inode(), true)
 		return nil
 	}
 
+	buf := make([]byte, 1024*1024*4) // should make this a loop and parse stuff as i go..
+	pos := uint64(0)
+	records := 0
 	for {
-		n, err := ctx.Read(f.Inode().String(), buf, pos)
+		var n int
+		_, span := f.radosSpan(ctx, "rados.Read", f.Inode().String(), f.IsDir())
+		err := f.fs.retry(ctx, f.IsDir(), func(ioctx *rados.IOContext) (err error) {
+			n, err = ioctx.Read(f.Inode().String(), buf, pos)
+			return err
+		})
+		endSpan(span, err)
 		if err != nil {
-			fmt.Fprintf(debuglog, "Failed to read inode: %v, error: %v\n", f.Inode().String(), err)
+			f.fs.logger.Debug("Failed to read inode", "inode", f.Inode(), "error", err)
 			return err
 		}
+		f.fs.metrics.transferred(f.isDir, "read", n)
 		mdEntries := strings.Split(string(buf[:n]), "\n")
 		for _, entry := range mdEntries {
 			status, stat, err := parseMdEntry([]byte(entry))
 			if err == MdEntryEmpty {
 				continue
 			} else if err != nil {
-				fmt.Fprintf(debuglog, "Failed to parse MD entry, entry: %v, error: %v\n", entry, err)
+				f.fs.logger.Warn("Failed to parse metadata entry", "inode", f.Inode(), "entry", entry, "error", err)
+				return err
 			}
-			if status == '+' {
-				fmt.Fprintf(debuglog, "Readdir on: %v, adding %v, isdir: %v\n", f.Inode().String(), stat.Name(), stat.IsDir())
-				f.children[stat.Name()] = stat.Inode()
-				f.fs.cache.Add(stat.Inode(), &fsObj{
-					name:     stat.Name(),
-					size:     stat.Size(),
-					mode:     stat.Mode(),
-					modTime:  stat.ModTime(),
-					isDir:    stat.IsDir(),
-					inode:    stat.Inode(),
-					fs:       f.fs,
-					children: make(map[string]uuid.UUID),
-				})
-			} else if status == '-' {
-				fmt.Fprintf(debuglog, "Readdir on: %v, removing %v\n", f.Inode().String(), stat.Name())
-				delete(f.children, stat.Name())
-			} else if status == 'I' {
-				f.name = stat.Name()
-				f.size = stat.Size()
-				f.mode = stat.Mode()
-				f.modTime = stat.ModTime()
-				f.isDir = stat.IsDir()
-			} else {
-				return fmt.Errorf("Weird status: %v for entry: %v\n", status, entry)
+			records++
+			if err := f.applyEntry(status, stat); err != nil {
+				return fmt.Errorf("%w of entry %q", err, entry)
 			}
 		}
 
@@ -341,56 +832,168 @@ func (f *fsObj) ReadMD() error {
 
 	}
 	f.lastRead = time.Now()
+	f.lastSize = stat.Size
+	f.records = records
+	f.coherent = f.isDir && f.fs.watch(f.Inode(), true)
+	return nil
+}
+
+// applyEntry applies an entry read from disk to the object in memory, f
+// must be locked.
+func (f *fsObj) applyEntry(status byte, stat OrfsStat) error {
+	switch status {
+	case '+':
+		f.children[stat.Name()] = stat.Inode()
+		f.fs.cacheObj(&fsObj{
+			name:     stat.Name(),
+			size:     stat.Size(),
+			mode:     stat.Mode(),
+			modTime:  stat.ModTime(),
+			isDir:    stat.IsDir(),
+			inode:    stat.Inode(),
+			nlink:    stat.Nlink(),
+			target:   stat.LinkTarget(),
+			uid:      stat.Uid(),
+			gid:      stat.Gid(),
+			fs:       f.fs,
+			children: make(map[string]uuid.UUID),
+		})
+	case '-':
+		delete(f.children, stat.Name())
+	case 'I':
+		size, modTime := stat.Size(), stat.ModTime()
+		if f.dirty && f.size > size {
+			size = f.size
+		}
+		if f.dirty && f.modTime.After(modTime) {
+			modTime = f.modTime
+		}
+		f.name = stat.Name()
+		f.size = size
+		f.mode = stat.Mode()
+		f.modTime = modTime
+		f.isDir = stat.IsDir()
+		f.nlink = stat.Nlink()
+		f.target = stat.LinkTarget()
+		f.uid = stat.Uid()
+		f.gid = stat.Gid()
+		f.aclLoaded = false
+	default:
+		return fmt.Errorf("%w: status %c", ErrCorruptMetadata, status)
+	}
 	return nil
 }
 
 // Synchronizes the directory to disk.
-func (f *fsObj) ReSync() error {
-	ctx := f.fs.mdctx
+func (f *fsObj) ReSync() (err error) {
+	ctx, end := f.fs.startOp(context.Background(), "ReSync", slog.Any("inode", f.Inode()))
+	defer end(&err)
+	return f.reSync(ctx)
+}
 
-	if !f.IsDir() {
-		// Is not directory, write to datapool.
-		ctx = f.fs.ioctx
+// reSyncContext is ReSync with a context.
+func reSyncContext(ctx context.Context, obj OBJ) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.reSync(ctx)
 	}
+	return obj.ReSync()
+}
 
-	if f.ModTime().After(f.lastRead) {
-		fmt.Printf("ReSync: ModTime is after lastread\n")
+func (f *fsObj) reSync(ctx context.Context) error {
+	f.RLock()
+	changed := f.modTime.After(f.lastRead)
+	f.RUnlock()
+	if !changed {
+		return nil
+	}
+	return f.fs.call(f.IsDir(), func(ioctx *rados.IOContext) error {
 		// Stat it, if it exists -> lock it, defer unlock, truncate it.
-		_, err := ctx.Stat(f.Inode().String())
+		_, span := f.radosSpan(ctx, "rados.Stat", f.Inode().String(), f.IsDir())
+		_, err := ioctx.Stat(f.Inode().String())
+		endSpan(span, err)
 		if err == nil {
-			// Lock, truncate, unlock
-			fmt.Printf("ReSync: Locking Inode\n")
-			_, err := ctx.LockExclusive(f.Inode().String(), "Sync", f.Inode().String(), "Sync of dir", 0, nil)
+			// Lock, truncate, unlock. Same lock as the appends so none
+			// of them are lost by the rewrite.
+			cookie := uuid.New().String()
+			unlock, err := lockExclusive(ctx, f.fs.metrics, ioctx, f.Inode().String(), "AddEntry", cookie, "Sync of inode")
 			if err != nil {
 				return err
 			}
-			fmt.Printf("ReSync: Locked Inode\n")
-			defer ctx.Unlock(f.Inode().String(), "Sync", f.Inode().String())
+			defer unlock()
 		} else if err != rados.RadosErrorNotFound {
 			return err
 		}
 		// With Exclusive lock held, Re-read directory
-		if err := f.ReadMD(); err != rados.RadosErrorNotFound {
+		if err := f.readMD(ctx); err != nil && err != rados.RadosErrorNotFound {
 			return err
 		}
 
-		// Create initial "I"node for metadata file
-		var md []byte = makeMdEntry('I', f)
-		for _, Inode := range f.children {
-			obj, err := GetObjInode(f.fs, Inode)
-			if err != nil {
-				return err
-			}
-			md = append(md, makeMdEntryNewline('+', obj)...)
-		}
-		if len(md) == 0 {
-			panic("Metadata entry can not be zero!")
+		md, err := f.compactMD()
+		if err != nil {
+			return err
 		}
-		err = ctx.WriteFull(f.Inode().String(), md)
+		_, span = f.radosSpan(ctx, "rados.WriteFull", f.Inode().String(), f.IsDir())
+		err = ioctx.WriteFull(f.Inode().String(), md)
+		endSpan(span, err)
 		if err != nil {
 			return err
 		}
+		f.fs.metrics.transferred(f.IsDir(), "write", len(md))
+		f.Lock()
+		f.dirty = false
+		f.Unlock()
+		f.notify(ctx, "")
+		return nil
+	})
+}
+
+// compactMD returns the inode record followed by an entry for each name in
+// the directory. The entries use the names the inodes are linked under, an
+// inode with several links in the directory gets one entry per link.
+func (f *fsObj) compactMD() ([]byte, error) {
+	f.RLock()
+	md := makeMdEntry('I', f.statLocked())
+	children := make(map[string]uuid.UUID, len(f.children))
+	for name, inode := range f.children {
+		children[name] = inode
+	}
+	f.RUnlock()
+	for name, inode := range children {
+		obj, err := GetObjInode(f.fs, inode)
+		if err != nil {
+			return nil, err
+		}
+		md = append(md, makeMdEntryNewline('+', renamedStat(obj, name))...)
 	}
+	return md, nil
+}
 
-	return nil
+// refreshEntry rewrites the entry name of the directory with the current
+// size and mtime of o, if the entry still refers to o.
+func (f *fsObj) refreshEntry(ctx context.Context, name string, o OrfsStat) error {
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		f.RLock()
+		inode, ok := f.children[name]
+		f.RUnlock()
+		if !ok || inode != o.Inode() {
+			// Renamed or removed since it was opened.
+			return nil
+		}
+		st := renamedStat(o, name)
+		entries := append(makeMdEntryNewline('-', st), makeMdEntryNewline('+', st)...)
+		start := time.Now()
+		_, span := f.radosSpan(ctx, "rados.Append", f.Inode().String(), true)
+		err := ioctx.Append(f.Inode().String(), entries)
+		endSpan(span, err)
+		f.fs.metrics.observeOp("AddMDEntry", start, err)
+		if err != nil {
+			return err
+		}
+		f.fs.metrics.transferred(true, "write", len(entries))
+		return nil
+	})
+	if err == nil {
+		f.notify(ctx, name)
+	}
+	return err
 }
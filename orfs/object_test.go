@@ -0,0 +1,63 @@
+package orfs
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"os"
+	"testing"
+)
+
+func TestCacheObjKeepsCachedObject(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	inode := uuid.New()
+	first := &fsObj{inode: inode, fs: fs, size: 1}
+	if got := fs.cacheObj(first); got != first {
+		t.Fatalf("cacheObj of an uncached inode returned %p, want %p", got, first)
+	}
+	// A directory re-read builds a new object from its entry.
+	second := &fsObj{inode: inode, fs: fs, size: 2}
+	if got := fs.cacheObj(second); got != first {
+		t.Fatalf("cacheObj replaced the cached object")
+	}
+	if o, _ := fs.cache.Get(inode); o != first {
+		t.Fatalf("Cache holds %p, want %p", o, first)
+	}
+}
+
+func TestCompactMDKeepsLinkNames(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	child := &fsObj{name: "a", inode: uuid.New(), fs: fs, mode: 0644, nlink: 3, coherent: true}
+	fs.cacheObj(child)
+	// Two links in the directory and one renamed in from elsewhere.
+	dir := &fsObj{inode: uuid.New(), fs: fs, isDir: true, mode: os.ModeDir | 0755, children: map[string]uuid.UUID{
+		"a":       child.inode,
+		"b":       child.inode,
+		"renamed": child.inode,
+	}}
+	md, err := dir.compactMD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for i, entry := range bytes.Split(md, []byte("\n")) {
+		state, stat, err := parseMdEntry(entry)
+		if err != nil {
+			t.Fatalf("entry %q: %v", entry, err)
+		}
+		if i == 0 {
+			if state != 'I' || stat.Inode() != dir.inode {
+				t.Fatalf("first entry %c of %v, want the inode record", state, stat.Inode())
+			}
+			continue
+		}
+		if state != '+' || stat.Inode() != child.inode {
+			t.Errorf("entry %c %v of %v, want + of %v", state, stat.Name(), stat.Inode(), child.inode)
+		}
+		names[stat.Name()] = true
+	}
+	for name := range dir.children {
+		if !names[name] {
+			t.Errorf("%v lost by the compaction, entries: %v", name, names)
+		}
+	}
+}
@@ -1,28 +1,69 @@
 package orfs
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/google/uuid"
 	"github.com/hashicorp/golang-lru"
-	"io"
-	"io/ioutil"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var log io.Writer = ioutil.Discard
-var debuglog io.Writer = ioutil.Discard
-
+// Orfs is an ORFS filesystem, a pair of RADOS pools mounted by this client.
+//
+// One Orfs is meant to be shared by all goroutines of a process. After
+// SetLogger and Connect, which must be called before it is shared,
+// all of its methods and those of the OBJs and Files it returns are safe for
+// concurrent use. Each inode has one in memory object, shared through the
+// cache and guarded by its own lock, the lock is held while its fields are
+// read or changed but not across RADOS operations on other inodes, except
+// for a directory while a new entry's inode is written. Changes to RADOS
+// objects are serialized by RADOS locks, not by these, so goroutines of one
+// client and separate clients see the same guarantees. A File may be used by
+// several goroutines, see File. Close flushes the open Files and
+// disconnects.
 type Orfs struct {
-	conn   *rados.Conn
-	ioctx  *rados.IOContext
-	mdctx  *rados.IOContext
+	// Connection, replaced by reconnect, see conn.go.
+	connMu      sync.RWMutex
+	cluster     *cluster
+	connGen     uint64
+	closed      bool
+	reconnectMu sync.Mutex
+	// Context of work in the background, like read-ahead and flushes of
+	// write buffers by their timer. It is cancelled by Close.
+	bg     context.Context
+	stopBg context.CancelFunc
+
 	pool   string
 	mdpool string
+	cfg    Config
 	Root   OBJ
-	cache  lru.Cache
+	cache  *lru.Cache
+	// Logger of this instance, see SetLogger.
+	logger *slog.Logger
+	// nil unless enabled with EnableMetrics.
+	metrics *Metrics
+	// Serves the metrics if Config.MetricsAddr is set.
+	metricsServer *http.Server
+	// Tracer of this instance, see SetTracerProvider.
+	tracer trace.Tracer
+	// Identifies this client in notifies.
+	id      string
+	watchMu sync.Mutex
+	watches map[uuid.UUID]*inodeWatch
+	// Files holding a lease, by inode.
+	leaseMu sync.Mutex
+	leases  map[uuid.UUID]map[*File]bool
+	// Open Files, see Close.
+	filesMu sync.Mutex
+	files   map[*File]struct{}
 }
 
 // Creates a new instance of ORFS
@@ -30,29 +71,45 @@ type Orfs struct {
 // Both pools can be the same pool as long as the pool supports
 // partial writes, an erasure coded pool is not supported for
 // metadata.
-func NewORFS(pool, mdpool string, cacheSize int) *Orfs {
+func NewORFS(pool, mdpool string, cacheSize int) (*Orfs, error) {
+	return New(Config{Pool: pool, MetadataPool: mdpool, CacheSize: cacheSize})
+}
+
+// Creates a new instance of ORFS configured by cfg, it connects with
+// Connect.
+func New(cfg Config) (*Orfs, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
 	c := new(Orfs)
-	c.pool = pool
-	c.mdpool = mdpool
-	cache, err := lru.New(cacheSize)
+	c.cfg = cfg
+	c.pool = cfg.Pool
+	c.mdpool = cfg.MetadataPool
+	c.id = uuid.New().String()
+	c.watches = make(map[uuid.UUID]*inodeWatch)
+	c.leases = make(map[uuid.UUID]map[*File]bool)
+	c.files = make(map[*File]struct{})
+	c.bg, c.stopBg = context.WithCancel(context.Background())
+	cache, err := lru.NewWithEvict(cfg.CacheSize, func(key, value interface{}) {
+		// Only directories in the cache are kept coherent, inodes
+		// with leases stay watched until the last lease is released.
+		c.metrics.cacheEvent("eviction")
+		c.unwatch(key.(uuid.UUID))
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	c.cache = *cache
-	return c
-}
-
-// Sets the log output, default is ioutil.discard
-func (fs *Orfs) SetLog(slog io.Writer) {
-	log = slog
-}
-
-// Sets the debuglog output, default is ioutil.discard
-func (fs *Orfs) SetDebugLog(dlog io.Writer) {
-	debuglog = dlog
+	c.cache = cache
+	c.SetLogger(cfg.Logger)
+	if cfg.MetricsAddr != "" {
+		c.EnableMetrics()
+	}
+	c.tracer = defaultTracer()
+	return c, nil
 }
 
-func (fs *Orfs) getRootDir() (OBJ, error) {
+func (fs *Orfs) getRootDir(ctx context.Context) (OBJ, error) {
 	rootUUID := uuid.UUID{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
 
 	root := fsObj{
@@ -62,64 +119,48 @@ func (fs *Orfs) getRootDir() (OBJ, error) {
 		modTime:  time.Now(),
 		isDir:    true,
 		inode:    rootUUID,
+		nlink:    1,
 		fs:       fs,
 		children: make(map[string]uuid.UUID),
 	}
 
 	//root.Add(&root)
-	err := root.ReSync()
+	err := root.reSync(ctx)
 	return &root, err
 
 }
 
 // Connect to Ceph
-func (fs *Orfs) Connect() error {
-	fmt.Fprint(debuglog, "Connect: Creating connection\n")
-	if conn, err := rados.NewConn(); err != nil {
-		fmt.Fprintf(debuglog, "ERROR: Connect: NewConn: %v\n", err)
-		return err
-	} else {
-		fs.conn = conn
-	}
-	fmt.Fprint(debuglog, "Conncet: Reading config file\n")
-	if err := fs.conn.ReadDefaultConfigFile(); err != nil {
-		fmt.Fprintf(debuglog, "ERROR: Connect: ReadConfig: %v\n", err)
-		return err
-	}
-	fmt.Fprint(debuglog, "Connect: Connecting to ceph\n")
-	if err := fs.conn.Connect(); err != nil {
-		fmt.Fprintf(debuglog, "ERROR: Connect: Connect: %v\n", err)
-		return err
-	}
-	fmt.Fprintf(debuglog, "Connect: Creating IO Context for pool: %v\n", fs.pool)
-	if ioctx, err := fs.conn.OpenIOContext(fs.pool); err != nil {
-		fmt.Fprintf(debuglog, "ERROR: Connect: OpenIOContext: %v\n", err)
-		return err
-	} else {
-		fs.ioctx = ioctx
-	}
-	fmt.Fprintf(debuglog, "Connect: Creating IO context for pool: %v\n", fs.mdpool)
-	if mdctx, err := fs.conn.OpenIOContext(fs.mdpool); err != nil {
-		fmt.Fprintf(debuglog, "ERROR: Connect: OpenIOContext: %v\n", err)
+func (fs *Orfs) Connect() (err error) {
+	defer pathError("connect", fs.pool, &err)
+	ctx, end := fs.startOp(context.Background(), "Connect")
+	defer end(&err)
+	c, err := fs.dial()
+	if err != nil {
 		return err
-	} else {
-		fs.mdctx = mdctx
 	}
+	fs.connMu.Lock()
+	fs.cluster = c
+	fs.connMu.Unlock()
 
-	fmt.Fprintf(debuglog, "Connect: Initialized\n")
-	fmt.Fprintf(debuglog, "Connect: Loading rootdir\n")
-	root, err := fs.getRootDir()
+	root, err := fs.getRootDir(ctx)
 	if err != nil {
 		return (err)
 	}
-	fmt.Fprintf(log, "Loaded rootdir\n")
+	fs.logger.Info("Loaded rootdir")
 	fs.Root = root
+
+	if err := fs.recoverJournal(ctx); err != nil {
+		return err
+	}
+	if fs.cfg.MetricsAddr != "" && fs.metricsServer == nil {
+		return fs.serveMetrics()
+	}
 	return nil
 }
 
 func pathSplit(path string) []string {
 	fpath := strings.Split(path, "/")
-	fmt.Println("Path: ", fpath)
 	// Delete empty strings after the split.. Can we make this more efficient?
 	for i := 0; i < len(fpath); i++ {
 		if fpath[i] == "" {
@@ -127,151 +168,745 @@ func pathSplit(path string) []string {
 			i--
 		}
 	}
-	fmt.Println("Path After cleanup: ", fpath)
 	return fpath
 }
 
+// Maximum number of symlinks followed while resolving a path, same as
+// MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
 // Get an object (File, Directory) from ORFS.
 // name is the path, for example /testdir/testfile
 // If GetParent is set it returns the parent of testfile.
+// Symlinks are followed, including a symlink as the last element.
 func (fs *Orfs) GetObject(name string, GetParent bool) (OBJ, error) {
-	obj := fs.Root
-	path := pathSplit(name)
+	return fs.GetObjectContext(context.Background(), name, GetParent)
+}
 
-	if len(path) == 0 {
-		// Path is empty, is root
-		return fs.Root, nil
+// GetObjectContext is GetObject with a context, see WithCaller.
+func (fs *Orfs) GetObjectContext(ctx context.Context, name string, GetParent bool) (_ OBJ, err error) {
+	defer pathError("lookup", name, &err)
+	ctx, end := fs.startOp(ctx, "GetObject", slog.String("path", name), slog.Bool("parent", GetParent))
+	defer end(&err)
+	return fs.resolve(ctx, name, GetParent, true)
+}
+
+// Get an object as c, c needs search permission on every directory on the
+// path.
+func (fs *Orfs) GetObjectAs(c *Caller, name string, GetParent bool) (OBJ, error) {
+	return fs.GetObjectContext(WithCaller(context.Background(), c), name, GetParent)
+}
+
+// resolve walks path from root. Symlinks in the middle of the path are
+// always followed, a symlink as the last element only if followLast is set.
+// Relative symlinks and ".." are resolved against the directories walked so
+// far, so ".." never leaves root.
+func (fs *Orfs) resolve(ctx context.Context, name string, GetParent, followLast bool) (OBJ, error) {
+	dirs, err := fs.resolveDirs(ctx, name, GetParent, followLast)
+	if err != nil {
+		return nil, err
 	}
+	return dirs[len(dirs)-1], nil
+}
+
+// resolveDirs is resolve returning every directory from root to the object,
+// the object last.
+func (fs *Orfs) resolveDirs(ctx context.Context, name string, GetParent, followLast bool) ([]OBJ, error) {
+	c := CallerFromContext(ctx)
+	path := pathSplit(name)
 
-	skip := 0
 	if GetParent {
-		skip = 1
+		if len(path) == 0 {
+			return []OBJ{fs.Root}, nil
+		}
+		path = path[:len(path)-1]
+		followLast = true
 	}
 
-	// Call update on parentObject to populate children if it hasn't happened yet.
-	for i := 0; i < len(path)-skip; i++ {
-		fmt.Fprintf(debuglog, "FindObject: current path: %v, i: %v, len(path): %v\n", path[i], i, len(path))
-		if _obj, err := obj.Get(path[i]); err == nil {
-			fmt.Fprintf(debuglog, "FindObject: Found child: %v\n", _obj.Name())
-			obj = _obj
-		} else {
-			fmt.Fprintf(debuglog, "FindObject: Couldn't find parent object\n")
+	dirs := []OBJ{fs.Root}
+	links := 0
+	for len(path) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		obj := dirs[len(dirs)-1]
+		elem := path[0]
+		path = path[1:]
+
+		switch elem {
+		case ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+		if !obj.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		if err := c.access(obj, permExec); err != nil {
+			return nil, err
+		}
+
+		_obj, err := obj.Get(elem)
+		if err == rados.RadosErrorNotFound {
 			// Parent object doesn't exist
 			return nil, os.ErrNotExist
+		} else if err != nil {
+			return nil, err
+		}
+
+		if _obj.Mode()&os.ModeSymlink != 0 && (len(path) > 0 || followLast) {
+			links++
+			if links > maxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			target := _obj.LinkTarget()
+			fs.logger.DebugContext(ctx, "Following symlink", "path", name, "link", elem, "target", target)
+			if strings.HasPrefix(target, "/") {
+				dirs = dirs[:1]
+			}
+			path = append(pathSplit(target), path...)
+			continue
 		}
+		dirs = append(dirs, _obj)
 	}
-	return obj, nil
+	return dirs, nil
 }
 
 // Create a directory in ORFS.
 // name is the path, for example /test/NewDir
 // The parent directory "/test" must exist.
 func (fs *Orfs) Mkdir(name string, perm os.FileMode) error {
-	fmt.Fprintf(debuglog, "Mkdir: %v\n", name)
+	return fs.MkdirContext(context.Background(), name, perm)
+}
+
+// MkdirContext is Mkdir with a context, see WithCaller.
+func (fs *Orfs) MkdirContext(ctx context.Context, name string, perm os.FileMode) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("mkdir", name, &err)
+	ctx, end := fs.startOp(ctx, "Mkdir", slog.String("path", name))
+	defer end(&err)
 
-	dir, err := fs.GetObject(name, true)
+	dir, err := fs.GetObjectContext(ctx, name, true)
 	if err != nil {
 		return err
 	}
+	if err := c.access(dir, permWrite|permExec); err != nil {
+		return err
+	}
 
 	path := pathSplit(name)
-	subdir, err := NewObj(fs, path[len(path)-1:][0], true)
+	if len(path) == 0 || dir.HasChild(path[len(path)-1]) {
+		return os.ErrExist
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mode := perm&(os.ModePerm|os.ModeSetgid|os.ModeSticky) | os.ModeDir
+	subdir, err := newObj(ctx, fs, c, dir, path[len(path)-1:][0], mode, "")
 	if err != nil {
 		return err
 	}
-	err = dir.Add(subdir)
-	return err
+	// Add checks for the name under the directory lock, if another
+	// client created it first our inode is discarded.
+	if err := addContext(ctx, dir, subdir); err != nil {
+		subdir.FDelete()
+		return err
+	}
+	return nil
+}
+
+// Create a directory as c, the directory is owned by c.
+func (fs *Orfs) MkdirAs(c *Caller, name string, perm os.FileMode) error {
+	return fs.MkdirContext(WithCaller(context.Background(), c), name, perm)
 }
 
 // Open a file or directory in ORFS.
 // Works the same as os.OpenFile
 // name is the path, for example /test/NewDir or /test/testfile
 func (fs *Orfs) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
-	fmt.Fprintf(debuglog, "OpenFile: %v, flag: %v, perm: %v\n", name, flag, perm)
-	obj, err := fs.GetObject(name, false)
-	if err == os.ErrNotExist && flag&os.O_CREATE > 0 {
+	return fs.OpenFileContext(context.Background(), name, flag, perm)
+}
+
+// OpenFileContext is OpenFile with a context, see WithCaller.
+func (fs *Orfs) OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (_ *File, err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("open", name, &err)
+	ctx, end := fs.startOp(ctx, "OpenFile", slog.String("path", name), slog.Int("flag", flag))
+	defer end(&err)
+	accmode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	var obj OBJ
+	created := false
+	for {
+		obj, err = fs.GetObjectContext(ctx, name, false)
+		if !errors.Is(err, os.ErrNotExist) || flag&os.O_CREATE == 0 {
+			break
+		}
 		// Doesn't exist yet but O_CREATE is set so we try to create.
 		// Find parent
-		dir, err := fs.GetObject(name, true)
+		var dir OBJ
+		dir, err = fs.GetObjectContext(ctx, name, true)
 		if err != nil {
 			// Parent not found, return error
 			return nil, err
 		}
+		if err := c.access(dir, permWrite|permExec); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		// Create a new object and add it to obj
 		path := pathSplit(name)
-		obj, err = NewObj(fs, path[len(path)-1:][0], false)
+		obj, err = newObj(ctx, fs, c, dir, path[len(path)-1:][0], perm&os.ModePerm, "")
 		if err != nil {
 			return nil, err
 		}
-		err = dir.Add(obj)
-		if err != nil {
+		// Add checks for the name under the directory lock, if another
+		// client created it first our inode is discarded and theirs is
+		// opened.
+		err = addContext(ctx, dir, obj)
+		if errors.Is(err, os.ErrExist) && flag&os.O_EXCL == 0 {
+			obj.FDelete()
+			continue
+		} else if err != nil {
+			obj.FDelete()
 			return nil, err
 		}
-
-	} else if err != nil {
+		created = true
+		break
+	}
+	if err != nil {
 		return nil, err
+	} else if !created && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	} else if !created {
+		var want uint32
+		switch accmode {
+		case os.O_RDONLY:
+			want = permRead
+		case os.O_WRONLY:
+			want = permWrite
+		default:
+			want = permRead | permWrite
+		}
+		if flag&os.O_TRUNC != 0 {
+			want |= permWrite
+		}
+		if err := c.access(obj, want); err != nil {
+			return nil, err
+		}
 	}
-	return obj.Open()
+	if obj.IsDir() && (accmode != os.O_RDONLY || flag&os.O_TRUNC != 0) {
+		return nil, syscall.EISDIR
+	}
+	if flag&os.O_TRUNC != 0 && accmode != os.O_RDONLY && !created {
+		if err := fs.truncate(ctx, obj, 0); err != nil {
+			return nil, err
+		}
+	}
+	file, err := obj.Open()
+	if err != nil {
+		return nil, err
+	}
+	file.flag = flag
+	file.path = name
+	if accmode != os.O_RDONLY {
+		// Remember the entry so Sync can update the size shown in it.
+		path := pathSplit(name)
+		if dir, err := fs.GetObjectContext(ctx, name, true); err == nil && len(path) > 0 {
+			if d, ok := dir.(*fsObj); ok {
+				file.dir, file.name = d, path[len(path)-1]
+			}
+		}
+	}
+	return file, nil
+}
+
+// Open a file or directory as c. c needs read and/or write permission
+// depending on flag, a created file is owned by c.
+func (fs *Orfs) OpenFileAs(c *Caller, name string, flag int, perm os.FileMode) (*File, error) {
+	return fs.OpenFileContext(WithCaller(context.Background(), c), name, flag, perm)
 }
 
-// Remove an object
+// Remove an object and, if it is a directory, everything beneath it.
+// Only the names are removed, an inode and its data are freed when the last
+// link to it is gone.
 func (fs *Orfs) RemoveAll(name string) error {
-	fmt.Fprintf(debuglog, "Removeall: %v\n", name)
+	return fs.RemoveAllContext(context.Background(), name)
+}
+
+// RemoveAllContext is RemoveAll with a context, see WithCaller.
+func (fs *Orfs) RemoveAllContext(ctx context.Context, name string) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("removeall", name, &err)
+	ctx, end := fs.startOp(ctx, "RemoveAll", slog.String("path", name))
+	defer end(&err)
 	path := pathSplit(name)
-	dir, err := fs.GetObject(name, true)
+	if len(path) == 0 || path[len(path)-1] == "." || path[len(path)-1] == ".." {
+		// Root, or a name which isn't an entry of its own.
+		return &os.PathError{Op: "removeall", Path: name, Err: os.ErrInvalid}
+	}
+	dir, err := fs.GetObjectContext(ctx, name, true)
 	if err != nil {
 		return err
 	}
-	obj, err := dir.Get(path[len(path)-1:][0])
+	return fs.removeAll(ctx, c, dir, path[len(path)-1])
+}
+
+// removeAll removes the entry name of dir depth-first, a directory is
+// unlinked once it is empty so a failure leaves nothing unreachable.
+func (fs *Orfs) removeAll(ctx context.Context, c *Caller, dir OBJ, name string) error {
+	obj, err := dir.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := c.mayDelete(dir, obj); err != nil {
+		return err
+	}
+	if d, ok := obj.(*fsObj); ok && d.IsDir() {
+		if err := d.readMD(ctx); err != nil {
+			return err
+		}
+		for _, child := range d.childNames() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Removed by someone else meanwhile is fine.
+			if err := fs.removeAll(ctx, c, d, child); err != nil && err != os.ErrNotExist {
+				return err
+			}
+		}
+		// An entry created meanwhile would be left unreachable.
+		if err := d.readMD(ctx); err != nil {
+			return err
+		}
+		if len(d.childNames()) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	err = updateContext(ctx, dir, []OrfsStat{renamedStat(obj, name)}, nil)
+	if err != nil {
+		return err
+	}
+	return addLinkContext(ctx, obj, -1)
+}
+
+// Remove an object as c, c needs write permission on the parent directory.
+func (fs *Orfs) RemoveAllAs(c *Caller, name string) error {
+	return fs.RemoveAllContext(WithCaller(context.Background(), c), name)
+}
+
+// Create a hard link newName to the file oldName.
+// Directories can't be hard linked.
+func (fs *Orfs) Link(oldName, newName string) error {
+	return fs.LinkContext(context.Background(), oldName, newName)
+}
+
+// LinkContext is Link with a context, see WithCaller.
+func (fs *Orfs) LinkContext(ctx context.Context, oldName, newName string) (err error) {
+	c := CallerFromContext(ctx)
+	defer linkError("link", oldName, newName, &err)
+	ctx, end := fs.startOp(ctx, "Link", slog.String("path", newName), slog.String("target", oldName))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, oldName, false)
+	if err != nil {
+		return err
+	}
+	if obj.IsDir() {
+		return os.ErrPermission
+	}
+	dir, err := fs.GetObjectContext(ctx, newName, true)
+	if err != nil {
+		return err
+	}
+	if !dir.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if err := c.access(dir, permWrite|permExec); err != nil {
+		return err
+	}
+	path := pathSplit(newName)
+	if len(path) == 0 {
+		return os.ErrExist
+	}
+	if dir.HasChild(path[len(path)-1]) {
+		return os.ErrExist
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Count the link first, a crash before the directory entry is written
+	// leaks the inode rather than freeing it while it is still linked.
+	if err := addLinkContext(ctx, obj, 1); err != nil {
+		return err
+	}
+	err = updateContext(ctx, dir, nil, []OrfsStat{renamedStat(obj, path[len(path)-1])})
 	if err != nil {
+		// Not with ctx, which may be done already.
+		obj.AddLink(-1)
 		return err
 	}
-	err = dir.Delete(obj)
-	return err
+	return nil
+}
 
+// Create a hard link as c, c needs write permission on the new directory.
+func (fs *Orfs) LinkAs(c *Caller, oldName, newName string) error {
+	return fs.LinkContext(WithCaller(context.Background(), c), oldName, newName)
 }
 
+// Flags for RenameFlags, they match renameat2(2).
+const (
+	// Fail with os.ErrExist instead of replacing an existing destination.
+	RenameNoReplace = 1 << iota
+	// Atomically exchange source and destination, both must exist.
+	RenameExchange
+)
+
 // Rename an Object
+// An existing destination is atomically replaced, like rename(2).
 func (fs *Orfs) Rename(oldName, newName string) error {
-	fmt.Fprintf(debuglog, "Rename: oldName: %v, newName: %v\n", oldName, newName)
-	// Find old dir
-	oldDir, err := fs.GetObject(oldName, true)
+	return fs.RenameFlagsContext(context.Background(), oldName, newName, 0)
+}
+
+// RenameContext is Rename with a context, see WithCaller.
+func (fs *Orfs) RenameContext(ctx context.Context, oldName, newName string) error {
+	return fs.RenameFlagsContext(ctx, oldName, newName, 0)
+}
+
+// Rename an Object as c.
+func (fs *Orfs) RenameAs(c *Caller, oldName, newName string) error {
+	return fs.RenameContext(WithCaller(context.Background(), c), oldName, newName)
+}
+
+// Rename an Object with RenameNoReplace or RenameExchange semantics.
+// The rename is recorded in the journal before any directory is changed so
+// that it can be completed or rolled back if the client crashes halfway.
+func (fs *Orfs) RenameFlags(oldName, newName string, flags int) error {
+	return fs.RenameFlagsContext(context.Background(), oldName, newName, flags)
+}
+
+// RenameFlagsContext is RenameFlags with a context, see WithCaller.
+func (fs *Orfs) RenameFlagsContext(ctx context.Context, oldName, newName string, flags int) (err error) {
+	c := CallerFromContext(ctx)
+	defer linkError("rename", oldName, newName, &err)
+	ctx, end := fs.startOp(ctx, "Rename", slog.String("path", oldName), slog.String("target", newName))
+	defer end(&err)
+	if flags&RenameNoReplace != 0 && flags&RenameExchange != 0 {
+		return os.ErrInvalid
+	}
+	oldPath := pathSplit(oldName)
+	newPath := pathSplit(newName)
+	if len(oldPath) == 0 || len(newPath) == 0 {
+		// Can't rename root or rename something to root
+		return os.ErrInvalid
+	}
+
+	// Find old dir, with the directories above it for the cycle checks
+	oldDirs, err := fs.resolveDirs(ctx, oldName, true, true)
 	if err != nil {
 		return err
 	}
+	oldDir := oldDirs[len(oldDirs)-1]
 	// Grab object from dir
-	path := pathSplit(oldName)
-	obj, err := oldDir.Get(path[len(path)-1:][0])
+	obj, err := oldDir.Get(oldPath[len(oldPath)-1])
 	if err != nil {
 		return err
 	}
 	// Find new dir
-	newDir, err := fs.GetObject(newName, true)
+	newDirs, err := fs.resolveDirs(ctx, newName, true, true)
 	if err != nil {
 		return err
 	}
-	// Rename obj
-	obj.Rename(path[len(path)-1:][0])
+	newDir := newDirs[len(newDirs)-1]
+	if !newDir.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if err := c.mayDelete(oldDir, obj); err != nil {
+		return err
+	}
+	if err := c.access(newDir, permWrite|permExec); err != nil {
+		return err
+	}
 
-	// Link obj object to new dir
-	err = newDir.Add(obj)
-	if err != nil {
+	intent := &renameIntent{
+		id:      uuid.New(),
+		kind:    'R',
+		oldDir:  oldDir.Inode(),
+		newDir:  newDir.Inode(),
+		inode:   obj.Inode(),
+		isDir:   obj.IsDir(),
+		oldName: oldPath[len(oldPath)-1],
+		newName: newPath[len(newPath)-1],
+	}
+
+	// A directory can't be moved beneath itself.
+	if obj.IsDir() && inSubtree(obj, newDirs) {
+		return os.ErrInvalid
+	}
+
+	var target OBJ
+	if newDir.HasChild(intent.newName) {
+		if target, err = newDir.Get(intent.newName); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case target != nil && target.Inode() == obj.Inode():
+		// Source and destination are the same object, nothing to do.
+		if flags&RenameNoReplace != 0 {
+			return os.ErrExist
+		}
+		return nil
+	case flags&RenameExchange != 0:
+		if target == nil {
+			return os.ErrNotExist
+		}
+		if target.IsDir() && inSubtree(target, oldDirs) {
+			return os.ErrInvalid
+		}
+		intent.kind = 'X'
+	case target == nil:
+	case flags&RenameNoReplace != 0:
+		return os.ErrExist
+	case obj.IsDir() && !target.IsDir():
+		return syscall.ENOTDIR
+	case !obj.IsDir() && target.IsDir():
+		return syscall.EISDIR
+	case target.IsDir():
+		children, err := target.List()
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if target != nil {
+		if err := c.mayDelete(newDir, target); err != nil {
+			return err
+		}
+		intent.target = target.Inode()
+		intent.targetIsDir = target.IsDir()
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	// Unlink obj from old dir
-	err = oldDir.Unlink(obj)
+	release, err := fs.journalBegin(ctx, intent)
 	if err != nil {
 		return err
 	}
+	// After the journal lock is released.
+	defer fs.compactJournal(ctx)
+	defer release()
+	if err := fs.applyRename(ctx, intent, oldDir, newDir); err != nil {
+		return fs.abortRename(ctx, intent, newDir, err)
+	}
+	return fs.journalCommit(ctx, intent)
+}
+
+// abortRename handles a rename which failed with err. If the new name doesn't
+// link the inode nothing was changed and the intent is committed, so recovery
+// doesn't replay a rename the caller was told failed. Otherwise the rename is
+// visible already and is finished. Only if the directory can't be read or
+// the rename can't be finished the intent is left for recovery.
+func (fs *Orfs) abortRename(ctx context.Context, r *renameIntent, newDir OBJ, err error) error {
+	// ctx may be what failed the rename.
+	ctx = context.WithoutCancel(ctx)
+	if d, ok := newDir.(*fsObj); ok {
+		// The failed append may have been written anyway.
+		d.Lock()
+		d.coherent = false
+		d.Unlock()
+	}
+	if rerr := readMDContext(ctx, newDir); rerr != nil {
+		fs.logger.Warn("Rename failed, leaving it to recovery", "id", r.id, "error", err, "read_error", rerr)
+		return err
+	}
+	if linkedAt(newDir, r.newName) != r.inode {
+		if cerr := fs.journalCommit(ctx, r); cerr != nil {
+			fs.logger.Warn("Failed to commit aborted rename", "id", r.id, "error", cerr)
+		}
+		return err
+	}
+	if rerr := fs.replayRename(ctx, r); rerr != nil {
+		fs.logger.Warn("Rename failed, leaving it to recovery", "id", r.id, "error", err, "replay_error", rerr)
+		return err
+	}
 	return nil
 }
 
+// Rename an Object with flags as c, c needs write permission on both
+// directories.
+func (fs *Orfs) RenameFlagsAs(c *Caller, oldName, newName string, flags int) error {
+	return fs.RenameFlagsContext(WithCaller(context.Background(), c), oldName, newName, flags)
+}
+
+// inSubtree reports whether dir is one of dirs, the directories from root
+// to a resolved path, so the path is beneath dir.
+func inSubtree(dir OBJ, dirs []OBJ) bool {
+	for _, d := range dirs {
+		if d.Inode() == dir.Inode() {
+			return true
+		}
+	}
+	return false
+}
+
 // Stat an object
 func (fs *Orfs) Stat(name string) (os.FileInfo, error) {
-	fmt.Fprintf(debuglog, "Stat: %v\n", name)
-	obj, err := fs.GetObject(name, false)
+	return fs.StatContext(context.Background(), name)
+}
+
+// StatContext is Stat with a context, see WithCaller.
+func (fs *Orfs) StatContext(ctx context.Context, name string) (_ os.FileInfo, err error) {
+	defer pathError("stat", name, &err)
+	ctx, end := fs.startOp(ctx, "Stat", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
 	if err != nil {
 		return obj, err
 	}
-	return obj, obj.ReSync()
+	if err := readMDContext(ctx, obj); err != nil {
+		return nil, err
+	}
+	// A hard linked inode is cached under one of its names.
+	if path := pathSplit(name); len(path) > 0 && obj.Name() != path[len(path)-1] {
+		return renamedStat(obj, path[len(path)-1]), nil
+	}
+	return obj, nil
+}
+
+// Stat an object as c.
+func (fs *Orfs) StatAs(c *Caller, name string) (os.FileInfo, error) {
+	return fs.StatContext(WithCaller(context.Background(), c), name)
+}
+
+// Stat an object without following a symlink as the last element.
+func (fs *Orfs) Lstat(name string) (os.FileInfo, error) {
+	return fs.LstatContext(context.Background(), name)
+}
+
+// LstatContext is Lstat with a context, see WithCaller.
+func (fs *Orfs) LstatContext(ctx context.Context, name string) (_ os.FileInfo, err error) {
+	defer pathError("lstat", name, &err)
+	ctx, end := fs.startOp(ctx, "Lstat", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.resolve(ctx, name, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := readMDContext(ctx, obj); err != nil {
+		return nil, err
+	}
+	if path := pathSplit(name); len(path) > 0 && obj.Name() != path[len(path)-1] {
+		return renamedStat(obj, path[len(path)-1]), nil
+	}
+	return obj, nil
+}
+
+// Lstat an object as c.
+func (fs *Orfs) LstatAs(c *Caller, name string) (os.FileInfo, error) {
+	return fs.LstatContext(WithCaller(context.Background(), c), name)
+}
+
+// Create newName as a symlink to oldName, like os.Symlink.
+// oldName is stored as is and doesn't have to exist.
+func (fs *Orfs) Symlink(oldName, newName string) error {
+	return fs.SymlinkContext(context.Background(), oldName, newName)
+}
+
+// SymlinkContext is Symlink with a context, see WithCaller.
+func (fs *Orfs) SymlinkContext(ctx context.Context, oldName, newName string) (err error) {
+	c := CallerFromContext(ctx)
+	defer linkError("symlink", oldName, newName, &err)
+	ctx, end := fs.startOp(ctx, "Symlink", slog.String("path", newName), slog.String("target", oldName))
+	defer end(&err)
+	dir, err := fs.GetObjectContext(ctx, newName, true)
+	if err != nil {
+		return err
+	}
+	if err := c.access(dir, permWrite|permExec); err != nil {
+		return err
+	}
+	path := pathSplit(newName)
+	if len(path) == 0 {
+		return os.ErrExist
+	}
+	if dir.HasChild(path[len(path)-1]) {
+		return os.ErrExist
+	}
+	link, err := newObj(ctx, fs, c, dir, path[len(path)-1], os.FileMode(0777)|os.ModeSymlink, oldName)
+	if err != nil {
+		return err
+	}
+	if err := addContext(ctx, dir, link); err != nil {
+		link.FDelete()
+		return err
+	}
+	return nil
+}
+
+// Create a symlink as c, the symlink is owned by c.
+func (fs *Orfs) SymlinkAs(c *Caller, oldName, newName string) error {
+	return fs.SymlinkContext(WithCaller(context.Background(), c), oldName, newName)
+}
+
+// Returns the target of the symlink name.
+func (fs *Orfs) Readlink(name string) (string, error) {
+	return fs.ReadlinkContext(context.Background(), name)
+}
+
+// ReadlinkContext is Readlink with a context, see WithCaller.
+func (fs *Orfs) ReadlinkContext(ctx context.Context, name string) (_ string, err error) {
+	defer pathError("readlink", name, &err)
+	ctx, end := fs.startOp(ctx, "Readlink", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.resolve(ctx, name, false, false)
+	if err != nil {
+		return "", err
+	}
+	if obj.Mode()&os.ModeSymlink == 0 {
+		return "", os.ErrInvalid
+	}
+	return obj.LinkTarget(), nil
+}
+
+// Returns the target of the symlink name as c.
+func (fs *Orfs) ReadlinkAs(c *Caller, name string) (string, error) {
+	return fs.ReadlinkContext(WithCaller(context.Background(), c), name)
+}
+
+// Truncate changes the size of the file name, like os.Truncate.
+func (fs *Orfs) Truncate(name string, size int64) error {
+	return fs.TruncateContext(context.Background(), name, size)
+}
+
+// TruncateContext is Truncate with a context, see WithCaller.
+func (fs *Orfs) TruncateContext(ctx context.Context, name string, size int64) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("truncate", name, &err)
+	ctx, end := fs.startOp(ctx, "Truncate", slog.String("path", name), slog.Int64("size", size))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if obj.IsDir() {
+		return syscall.EISDIR
+	}
+	if err := c.access(obj, permWrite); err != nil {
+		return err
+	}
+	return fs.truncate(ctx, obj, size)
+}
+
+// Truncate the file name as c, c needs write permission on the file.
+func (fs *Orfs) TruncateAs(c *Caller, name string, size int64) error {
+	return fs.TruncateContext(WithCaller(context.Background(), c), name, size)
 }
@@ -1,6 +1,11 @@
 package orfs
 
 import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"net/http"
 	"os"
 )
 
@@ -8,14 +13,47 @@ func ExampleNewORFS() {
 	datapool := "test"
 	metadatapool := "test-metadata"
 	cachesize := 1024 * 1024 // number of metadata entries in cache
-	fs := NewORFS(datapool, metadatapool, cacheSize)
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(fs.Root)
+}
+
+func ExampleNew() {
+	cfg, err := LoadConfig("/etc/orfs.yaml")
+	if err != nil {
+		panic(err)
+	}
+	fs, err := New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func ExampleOrfs_SetLogger() {
+	datapool := "test"
+	metadatapool := "test-metadata"
+	cachesize := 1024 * 1024
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	fs.SetLogger(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 }
 
 func ExampleOrfs_SetLog() {
 	datapool := "test"
 	metadatapool := "test-metadata"
 	cachesize := 1024 * 1024
-	fs := NewORFS(pool, mdpool)
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
 	fs.SetLog(os.Stdout)
 }
 
@@ -23,7 +61,10 @@ func ExampleOrfs_SetDebugLog() {
 	datapool := "test"
 	metadatapool := "test-metadata"
 	cachesize := 1024 * 1024
-	fs := NewORFS(pool, mdpool, cachesize)
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
 	fs.SetDebugLog(os.Stdout)
 }
 
@@ -31,53 +72,107 @@ func ExampleOrfs_Connect() {
 	datapool := "test"
 	metadatapool := "test-metadata"
 	cachesize := 1024 * 1024
-	fs := NewORFS(pool, mdpool, cachesize)
-	err := fs.Connect()
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
 	if err != nil {
 		panic(err)
 	}
 }
 
+func ExampleOrfs_Close() {
+	fs, err := NewORFS("test", "test-metadata", 1024)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
+	if err != nil {
+		panic(err)
+	}
+	// Flushes files left open and releases their leases.
+	defer fs.Close(context.Background())
+}
+
 func ExampleOrfs_GetObject() {
 	datapool := "test"
 	metadatapool := "test-metadata"
 	cachesize := 1024 * 1024
-	fs := NewORFS(pool, mdpool, cachesize)
-	err := fs.Connect()
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
 	if err != nil {
 		panic(err)
 	}
 
 	// obj is the object for root, "/"
 	obj, err := fs.GetObject("/", false)
+	fmt.Println(obj, err)
 
 	// obj is the testfile
-	obj, err := fs.GetObject("/testdir/testfile", false)
+	obj, err = fs.GetObject("/testdir/testfile", false)
+	fmt.Println(obj, err)
 
 	// obj is the directory "testdir"
-	obj, err := fs.GetObject("/testdir/testfile", true)
+	obj, err = fs.GetObject("/testdir/testfile", true)
+	fmt.Println(obj, err)
 }
 
 func ExampleOrfs_Mkdir() {
-	fs := NewORFS(pool, mdpool, cachesize)
-	err := fs.Connect()
+	datapool := "test"
+	metadatapool := "test-metadata"
+	cachesize := 1024 * 1024
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
 	if err != nil {
 		panic(err)
 	}
-	err := fs.Mkdir("/test", os.FileMode(0755))
+	err = fs.Mkdir("/test", os.FileMode(0755))
 	if err != nil {
-		return (err)
+		panic(err)
 	}
 }
 
 func ExampleOrfs_OpenFile() {
-	fs := NewORFS(pool, mdpool, cachesize)
-	err := fs.Connect()
+	datapool := "test"
+	metadatapool := "test-metadata"
+	cachesize := 1024 * 1024
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	err = fs.Connect()
 	if err != nil {
 		panic(err)
 	}
 	file, err := fs.OpenFile("/test/testfile", 0, os.FileMode(0755))
 	if err != nil {
-		return (err)
+		panic(err)
+	}
+	file.Close()
+}
+
+func ExampleOrfs_EnableMetrics() {
+	datapool := "test"
+	metadatapool := "test-metadata"
+	cachesize := 1024 * 1024
+	fs, err := NewORFS(datapool, metadatapool, cachesize)
+	if err != nil {
+		panic(err)
+	}
+	metrics := fs.EnableMetrics()
+	// Either register the metrics with the registry of the server
+	prometheus.MustRegister(metrics)
+	// or serve them alone.
+	http.Handle("/metrics", metrics.Handler())
+	err = fs.Connect()
+	if err != nil {
+		panic(err)
 	}
 }
@@ -0,0 +1,265 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Caller is the identity an operation is performed as. Frontends serving
+// several users pass the Caller of each request to the *As methods, or in
+// the context with WithCaller, ORFS then enforces the permissions of files
+// and directories for it.
+type Caller struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// Superuser passes all permission checks, it is used by the methods which
+// don't take a Caller.
+var Superuser = &Caller{Uid: 0, Gid: 0}
+
+// Permission bits checked by access.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+func (c *Caller) isSuperuser() bool {
+	return c == nil || c.Uid == 0
+}
+
+func (c *Caller) inGroup(gid uint32) bool {
+	if c.Gid == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh re-reads the attributes of obj before they are checked. An object
+// built from its directory entry has the attributes the entry was written
+// with, changes since are only recorded in the inode.
+func refresh(obj OrfsStat) error {
+	if o, ok := obj.(*fsObj); ok {
+		if err := o.ReadMD(); err != nil && err != rados.RadosErrorNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// access checks that c has all the rwx bits in want on obj.
+func (c *Caller) access(obj OrfsStat, want uint32) error {
+	if c.isSuperuser() {
+		return nil
+	}
+	if err := refresh(obj); err != nil {
+		return err
+	}
+	if o, ok := obj.(*fsObj); ok {
+		acl, err := o.accessACL()
+		if err != nil {
+			return err
+		}
+		if acl != nil {
+			return c.aclAccess(obj, acl, want)
+		}
+	}
+	perm := posixMode(obj.Mode())
+	var bits uint32
+	switch {
+	case c.Uid == obj.Uid():
+		bits = perm >> 6
+	case c.inGroup(obj.Gid()):
+		bits = perm >> 3
+	default:
+		bits = perm
+	}
+	if bits&want != want {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// owns checks that c owns obj.
+func (c *Caller) owns(obj OrfsStat) error {
+	if c.isSuperuser() {
+		return nil
+	}
+	if err := refresh(obj); err != nil {
+		return err
+	}
+	if c.Uid != obj.Uid() {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// mayDelete checks that c may remove or replace the entry obj in dir, this
+// needs write and search permission on dir and, if dir is sticky, that c
+// owns dir or obj.
+func (c *Caller) mayDelete(dir, obj OrfsStat) error {
+	if err := c.access(dir, permWrite|permExec); err != nil {
+		return err
+	}
+	if c.isSuperuser() || dir.Mode()&os.ModeSticky == 0 {
+		return nil
+	}
+	if err := refresh(obj); err != nil {
+		return err
+	}
+	if c.Uid != dir.Uid() && c.Uid != obj.Uid() {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// posixMode returns the permission bits of m as the mode_t bits used by
+// stat(2), including setuid, setgid and sticky.
+func posixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// modeFromPosix is the inverse of posixMode, it only returns the permission bits.
+func modeFromPosix(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// Changes the permission bits of name.
+func (fs *Orfs) Chmod(name string, mode os.FileMode) error {
+	return fs.ChmodContext(context.Background(), name, mode)
+}
+
+// ChmodContext is Chmod with a context, see WithCaller.
+func (fs *Orfs) ChmodContext(ctx context.Context, name string, mode os.FileMode) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("chmod", name, &err)
+	ctx, end := fs.startOp(ctx, "Chmod", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if err := c.owns(obj); err != nil {
+		return err
+	}
+	return setAttrContext(ctx, obj, func(a *Attr) {
+		a.Mode = a.Mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		if !c.isSuperuser() && !c.inGroup(a.Gid) {
+			// Like chmod(2), setgid is dropped if the owner isn't a
+			// member of the group.
+			a.Mode &^= os.ModeSetgid
+		}
+	})
+}
+
+// Changes the permission bits of name as c, only the owner may do this.
+func (fs *Orfs) ChmodAs(c *Caller, name string, mode os.FileMode) error {
+	return fs.ChmodContext(WithCaller(context.Background(), c), name, mode)
+}
+
+// Changes the owner and group of name.
+func (fs *Orfs) Chown(name string, uid, gid int) error {
+	return fs.ChownContext(context.Background(), name, uid, gid)
+}
+
+// ChownContext is Chown with a context, see WithCaller.
+func (fs *Orfs) ChownContext(ctx context.Context, name string, uid, gid int) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("chown", name, &err)
+	ctx, end := fs.startOp(ctx, "Chown", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if !c.isSuperuser() {
+		if err := refresh(obj); err != nil {
+			return err
+		}
+		if uid != -1 && uint32(uid) != obj.Uid() {
+			return os.ErrPermission
+		}
+		if c.Uid != obj.Uid() || (gid != -1 && !c.inGroup(uint32(gid))) {
+			return os.ErrPermission
+		}
+	}
+	return setAttrContext(ctx, obj, func(a *Attr) {
+		if uid != -1 {
+			a.Uid = uint32(uid)
+		}
+		if gid != -1 {
+			a.Gid = uint32(gid)
+		}
+		if !c.isSuperuser() && !a.Mode.IsDir() {
+			// Changing owner clears setuid and setgid.
+			a.Mode &^= os.ModeSetuid | os.ModeSetgid
+		}
+	})
+}
+
+// Changes the owner and group of name as c. A uid or gid of -1 leaves it
+// unchanged. Only the superuser may change the owner, the owner may change
+// the group to one of its own groups.
+func (fs *Orfs) ChownAs(c *Caller, name string, uid, gid int) error {
+	return fs.ChownContext(WithCaller(context.Background(), c), name, uid, gid)
+}
+
+// Changes the modification time of name. ORFS doesn't keep an access time,
+// atime is accepted for compatibility with os.Chtimes and ignored.
+func (fs *Orfs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.ChtimesContext(context.Background(), name, atime, mtime)
+}
+
+// ChtimesContext is Chtimes with a context, see WithCaller.
+func (fs *Orfs) ChtimesContext(ctx context.Context, name string, atime time.Time, mtime time.Time) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("chtimes", name, &err)
+	ctx, end := fs.startOp(ctx, "Chtimes", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if err := c.owns(obj); err != nil {
+		return err
+	}
+	return setAttrContext(ctx, obj, func(a *Attr) {
+		a.ModTime = mtime
+	})
+}
+
+// Changes the modification time of name as c, only the owner may do this.
+func (fs *Orfs) ChtimesAs(c *Caller, name string, atime time.Time, mtime time.Time) error {
+	return fs.ChtimesContext(WithCaller(context.Background(), c), name, atime, mtime)
+}
@@ -0,0 +1,120 @@
+package orfs
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"sync"
+)
+
+// Default number of blocks read ahead of the position once a File is read
+// sequentially, the blocks are kept in memory until the position moves past
+// them.
+const defaultReadAheadBlocks = 2
+
+// readAhead caches blocks of a File read in the background. A Read starting
+// where the previous one ended counts as sequential, on the second one in a
+// row the following blocks are prefetched. Any seek or write drops the cache.
+type readAhead struct {
+	mu sync.Mutex
+	// Position the last Read ended at, if valid is set.
+	next   int64
+	valid  bool
+	seq    int
+	blocks map[int64]*raBlock
+}
+
+type raBlock struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// invalidate drops the cached blocks and restarts sequential detection.
+func (ra *readAhead) invalidate() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.valid = false
+	ra.seq = 0
+	ra.blocks = nil
+}
+
+// read reads into p at off, from the cache if the access is sequential and
+// cache reports that caching is allowed.
+func (ra *readAhead) read(ctx context.Context, f *fsObj, p []byte, off int64, cache func() bool) (int, error) {
+	ra.mu.Lock()
+	if ra.valid && off == ra.next {
+		ra.seq++
+	} else {
+		ra.seq = 0
+		ra.blocks = nil
+	}
+	sequential := ra.seq >= 1 && len(p) > 0
+	ra.mu.Unlock()
+	// Getting the lease may drop the cache, so it's done without ra.mu.
+	if !sequential || f.fs.cfg.ReadAheadBlocks < 0 || !cache() {
+		n, err := f.readBlocks(ctx, p, off)
+		ra.advance(off + int64(n))
+		return n, err
+	}
+
+	index := off / f.blockSize()
+	ra.mu.Lock()
+	if ra.blocks == nil {
+		ra.blocks = make(map[int64]*raBlock)
+	}
+	for n := range ra.blocks {
+		if n < index {
+			delete(ra.blocks, n)
+		}
+	}
+	for n := index; n <= index+int64(f.fs.cfg.ReadAheadBlocks); n++ {
+		if _, ok := ra.blocks[n]; !ok {
+			ra.blocks[n] = prefetch(f, n)
+		}
+	}
+	b := ra.blocks[index]
+	ra.mu.Unlock()
+
+	_, span := startSpan(ctx, "readahead.Wait", attribute.String("orfs.inode", f.Inode().String()), attribute.Int64("orfs.block", index))
+	<-b.done
+	span.End()
+	if b.err != nil && b.err != io.EOF {
+		// Drop the failed block and read it directly.
+		ra.mu.Lock()
+		if ra.blocks[index] == b {
+			delete(ra.blocks, index)
+		}
+		ra.mu.Unlock()
+		n, err := f.readBlocks(ctx, p, off)
+		ra.advance(off + int64(n))
+		return n, err
+	}
+	blockOff := int(off % f.blockSize())
+	if blockOff >= len(b.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[blockOff:])
+	ra.advance(off + int64(n))
+	return n, nil
+}
+
+func (ra *readAhead) advance(next int64) {
+	ra.mu.Lock()
+	ra.next, ra.valid = next, true
+	ra.mu.Unlock()
+}
+
+// prefetch starts reading block n in the background.
+func prefetch(f *fsObj, n int64) *raBlock {
+	f.fs.logger.Debug("Prefetch", "inode", f.Inode(), "block", n)
+	b := &raBlock{done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		buf := make([]byte, f.blockSize())
+		// Outlives the read which started it, so it isn't traced.
+		read, err := f.readBlocks(f.fs.bg, buf, n*f.blockSize())
+		b.data, b.err = buf[:read], err
+	}()
+	return b
+}
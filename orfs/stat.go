@@ -9,6 +9,18 @@ import (
 type OrfsStat interface {
 	os.FileInfo
 	Inode() uuid.UUID
+	Nlink() uint64
+	LinkTarget() string
+	Uid() uint32
+	Gid() uint32
+}
+
+// The attributes of an inode which can be changed with OBJ.SetAttr.
+type Attr struct {
+	Mode    os.FileMode
+	Uid     uint32
+	Gid     uint32
+	ModTime time.Time
 }
 
 type Istat struct {
@@ -17,6 +29,10 @@ type Istat struct {
 	mode    os.FileMode
 	modTime time.Time
 	isDir   bool
+	nlink   uint64
+	target  string
+	uid     uint32
+	gid     uint32
 	sys     interface{}
 	inode   uuid.UUID
 }
@@ -45,6 +61,40 @@ func (s *Istat) Inode() uuid.UUID {
 	return s.inode
 }
 
+func (s *Istat) Nlink() uint64 {
+	return s.nlink
+}
+
+func (s *Istat) LinkTarget() string {
+	return s.target
+}
+
+func (s *Istat) Uid() uint32 {
+	return s.uid
+}
+
+func (s *Istat) Gid() uint32 {
+	return s.gid
+}
+
 func (s *Istat) Sys() interface{} {
 	return s.sys
 }
+
+// Returns a copy of the stat of o with the name replaced, used to write
+// directory entries for an object under another name than it currently has.
+func renamedStat(o OrfsStat, name string) OrfsStat {
+	return &Istat{
+		name:    name,
+		size:    o.Size(),
+		mode:    o.Mode(),
+		modTime: o.ModTime(),
+		isDir:   o.IsDir(),
+		nlink:   o.Nlink(),
+		target:  o.LinkTarget(),
+		uid:     o.Uid(),
+		gid:     o.Gid(),
+		sys:     o.Sys(),
+		inode:   o.Inode(),
+	}
+}
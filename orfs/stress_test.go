@@ -0,0 +1,360 @@
+package orfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Stress tests sharing one Orfs between many goroutines, they are meant to
+// be run with go test -race. The tests which need a cluster use the pools
+// named by ORFS_TEST_POOL and ORFS_TEST_MDPOOL and are skipped without them,
+// the in-memory ones run everywhere.
+
+const stressWorkers = 64
+
+func testFS(t *testing.T, cacheSize int) *Orfs {
+	pool := os.Getenv("ORFS_TEST_POOL")
+	if pool == "" {
+		t.Skip("ORFS_TEST_POOL not set")
+	}
+	mdpool := os.Getenv("ORFS_TEST_MDPOOL")
+	if mdpool == "" {
+		mdpool = pool
+	}
+	fs, err := NewORFS(pool, mdpool, cacheSize)
+	if err != nil {
+		t.Fatalf("NewORFS: %v", err)
+	}
+	if err := fs.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := fs.Close(context.Background()); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return fs
+}
+
+// testDir creates a directory for one test and removes it afterwards.
+func testDir(t *testing.T, fs *Orfs) string {
+	dir := "/stress-" + uuid.New().String()
+	if err := fs.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir %v: %v", dir, err)
+	}
+	t.Cleanup(func() {
+		list, _ := fs.GetObject(dir, false)
+		if list != nil {
+			objs, _ := list.List()
+			for _, o := range objs {
+				fs.RemoveAll(dir + "/" + o.Name())
+			}
+		}
+		fs.RemoveAll(dir)
+	})
+	return dir
+}
+
+// Runs fn on stressWorkers goroutines at once and fails the test with the
+// errors they return.
+func stress(t *testing.T, fn func(worker int) error) {
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	start := make(chan struct{})
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-start
+			if err := fn(w); err != nil {
+				errs <- fmt.Errorf("worker %v: %v", w, err)
+			}
+		}(w)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStressCreate(t *testing.T) {
+	fs := testFS(t, 1000)
+	dir := testDir(t, fs)
+	const perWorker = 10
+
+	var mu sync.Mutex
+	won := 0
+	stress(t, func(w int) error {
+		for i := 0; i < perWorker; i++ {
+			f, err := fs.OpenFile(fmt.Sprintf("%v/%v-%v", dir, w, i), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+		// Every worker races for the same name, exactly one may win.
+		f, err := fs.OpenFile(dir+"/contended", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		mu.Lock()
+		won++
+		mu.Unlock()
+		return f.Close()
+	})
+	if won != 1 {
+		t.Errorf("%v workers created the contended file, want 1", won)
+	}
+
+	obj, err := fs.GetObject(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := obj.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := stressWorkers*perWorker + 1; len(list) != want {
+		t.Errorf("%v entries after creating, want %v", len(list), want)
+	}
+}
+
+func TestStressSharedFile(t *testing.T) {
+	fs := testFS(t, 1000)
+	dir := testDir(t, fs)
+	f, err := fs.OpenFile(dir+"/shared", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	const region = 4096
+	pattern := func(w int) []byte {
+		return bytes.Repeat([]byte{byte(w)}, region)
+	}
+	stress(t, func(w int) error {
+		if _, err := f.WriteAt(pattern(w), int64(w)*region); err != nil {
+			return err
+		}
+		// Position based calls on the same File race with the others.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := f.Read(make([]byte, 100)); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := f.Stat(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	stress(t, func(w int) error {
+		buf := make([]byte, region)
+		if _, err := f.ReadAt(buf, int64(w)*region); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, pattern(w)) {
+			return fmt.Errorf("region %v was overwritten", w)
+		}
+		return nil
+	})
+	stat, err := fs.Stat(dir + "/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(stressWorkers * region); stat.Size() != want {
+		t.Errorf("size %v, want %v", stat.Size(), want)
+	}
+}
+
+func TestStressTree(t *testing.T) {
+	fs := testFS(t, 1000)
+	dir := testDir(t, fs)
+	names := []string{"a", "b", "c", "d"}
+
+	stress(t, func(w int) error {
+		r := rand.New(rand.NewSource(int64(w)))
+		for i := 0; i < 50; i++ {
+			name := dir + "/" + names[r.Intn(len(names))]
+			other := dir + "/" + names[r.Intn(len(names))]
+			var err error
+			switch r.Intn(5) {
+			case 0:
+				err = fs.Mkdir(name, 0755)
+			case 1:
+				err = fs.RemoveAll(name)
+			case 2:
+				err = fs.Rename(name, other)
+			case 3:
+				_, err = fs.Stat(name)
+			case 4:
+				var obj OBJ
+				if obj, err = fs.GetObject(dir, false); err == nil {
+					_, err = obj.List()
+				}
+			}
+			// Other workers change the same names, only failures
+			// because of them are expected.
+			if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestStressEviction(t *testing.T) {
+	// A cache much smaller than the directory keeps evicting inodes
+	// other goroutines are looking up.
+	fs := testFS(t, 8)
+	dir := testDir(t, fs)
+	const files = 100
+	for i := 0; i < files; i++ {
+		f, err := fs.OpenFile(fmt.Sprintf("%v/%v", dir, i), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	stress(t, func(w int) error {
+		for i := 0; i < files; i++ {
+			name := fmt.Sprintf("%v/%v", dir, (i+w)%files)
+			if _, err := fs.Stat(name); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// memDir returns a directory which is only in memory. It is coherent, so
+// lookups in it never go to the cluster.
+func memDir(fs *Orfs) *fsObj {
+	dir := &fsObj{name: "dir", inode: uuid.New(), fs: fs, isDir: true, mode: os.ModeDir | 0755, coherent: true, children: make(map[string]uuid.UUID)}
+	return fs.cacheObj(dir).(*fsObj)
+}
+
+// memUpdate does what appendUpdate does to the directory in memory once the
+// entries are written.
+func memUpdate(dir *fsObj, rm, add []OrfsStat) error {
+	dir.Lock()
+	defer dir.Unlock()
+	if err := dir.checkUpdate(rm, add); err != nil {
+		return err
+	}
+	dir.applyUpdate(rm, add)
+	return nil
+}
+
+func TestStressDirInMemory(t *testing.T) {
+	const perWorker = 10
+	fs, _ := NewORFS("a", "a", 4*stressWorkers*perWorker)
+	dir := memDir(fs)
+
+	var mu sync.Mutex
+	won := 0
+	stress(t, func(w int) error {
+		for i := 0; i < perWorker; i++ {
+			o := &fsObj{name: fmt.Sprintf("%v-%v", w, i), inode: uuid.New(), fs: fs, mode: 0644, coherent: true, children: make(map[string]uuid.UUID)}
+			if err := memUpdate(dir, nil, []OrfsStat{o}); err != nil {
+				return err
+			}
+			if got, err := dir.Get(o.Name()); err != nil {
+				return err
+			} else if got != o {
+				return fmt.Errorf("%v resolves to another object", o.Name())
+			}
+			// Renamed within the directory, like Rename does.
+			moved := renamedStat(o, o.Name()+"-moved")
+			if err := memUpdate(dir, []OrfsStat{o}, []OrfsStat{moved}); err != nil {
+				return err
+			}
+			if dir.HasChild(o.Name()) {
+				return fmt.Errorf("%v still linked after the rename", o.Name())
+			}
+			// A re-read of the directory replays the entries.
+			dir.Lock()
+			err := dir.applyEntry('-', moved)
+			if err == nil {
+				err = dir.applyEntry('+', moved)
+			}
+			dir.Unlock()
+			if err != nil {
+				return err
+			}
+			// Everything reading the directory races with the others.
+			dir.childNames()
+			if _, err := dir.compactMD(); err != nil {
+				return err
+			}
+			if _, err := dir.List(); err != nil {
+				return err
+			}
+			if i%2 == 1 {
+				if err := memUpdate(dir, []OrfsStat{moved}, nil); err != nil {
+					return err
+				}
+			}
+		}
+		// Every worker races for the same name, exactly one may win.
+		o := &fsObj{name: "contended", inode: uuid.New(), fs: fs, mode: 0644, coherent: true, children: make(map[string]uuid.UUID)}
+		err := memUpdate(dir, nil, []OrfsStat{o})
+		if errors.Is(err, os.ErrExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		mu.Lock()
+		won++
+		mu.Unlock()
+		return nil
+	})
+	if won != 1 {
+		t.Errorf("%v workers linked the contended name, want 1", won)
+	}
+	want := stressWorkers*(perWorker-perWorker/2) + 1
+	if names := dir.childNames(); len(names) != want {
+		t.Errorf("%v entries, want %v", len(names), want)
+	}
+	md, err := dir.compactMD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bytes.Split(md, []byte("\n"))); n != want+1 {
+		t.Errorf("%v records in the compacted directory, want %v", n, want+1)
+	}
+}
+
+func TestStressCacheObj(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	inode := uuid.New()
+	got := make([]OBJ, stressWorkers)
+	stress(t, func(w int) error {
+		// Every re-read of a directory builds a new object for the inode.
+		got[w] = fs.cacheObj(&fsObj{inode: inode, fs: fs, size: int64(w), children: make(map[string]uuid.UUID)})
+		return nil
+	})
+	for w, o := range got {
+		if o != got[0] {
+			t.Fatalf("worker %v got %p, worker 0 got %p", w, o, got[0])
+		}
+	}
+}
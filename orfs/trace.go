@@ -0,0 +1,77 @@
+package orfs
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+)
+
+// Public operations run in a span, a child of the span in the context they
+// are given. The RADOS calls made for them, block reads and writes, entry
+// appends and waits for locks, get child spans with the inode and pool they
+// are on. Work without a span to report to, like write-back and read-ahead
+// in the background, isn't traced.
+
+const tracerName = "github.com/cetex/ORFS/orfs"
+
+// SetTracerProvider sets the provider of the spans of this instance, the
+// default is the global one of otel. Like SetLogger it must be called before
+// the Orfs is shared.
+func (fs *Orfs) SetTracerProvider(tp trace.TracerProvider) {
+	fs.tracer = tp.Tracer(tracerName)
+}
+
+// startSpan starts a span for a backend call as a child of the span in ctx,
+// it is a no-op span if ctx has none.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// radosSpan starts a span for a call on the object oid of inode, in the
+// metadata pool if md is set.
+func (f *fsObj) radosSpan(ctx context.Context, name, oid string, md bool) (context.Context, trace.Span) {
+	pool := f.fs.pool
+	if md {
+		pool = f.fs.mdpool
+	}
+	return startSpan(ctx, name,
+		attribute.String("orfs.inode", f.Inode().String()),
+		attribute.String("rados.pool", pool),
+		attribute.String("rados.object", oid))
+}
+
+// endSpan ends span, recording err if the call failed.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if !expectedError(mapError(err)) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// Span attributes of the log attributes of an operation.
+func spanAttrs(attrs []slog.Attr) []attribute.KeyValue {
+	kv := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		key := "orfs." + a.Key
+		switch a.Value.Kind() {
+		case slog.KindInt64:
+			kv = append(kv, attribute.Int64(key, a.Value.Int64()))
+		case slog.KindBool:
+			kv = append(kv, attribute.Bool(key, a.Value.Bool()))
+		default:
+			kv = append(kv, attribute.String(key, a.Value.String()))
+		}
+	}
+	return kv
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
@@ -0,0 +1,61 @@
+package orfs
+
+import (
+	"context"
+	"github.com/google/uuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"syscall"
+	"testing"
+)
+
+func TestStartOpSpans(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	rec := tracetest.NewSpanRecorder()
+	fs.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	// Backend spans without an operation to report to aren't started.
+	_, span := startSpan(context.Background(), "rados.Read")
+	span.End()
+	if n := len(rec.Ended()); n != 0 {
+		t.Fatalf("%v spans without a parent, want 0", n)
+	}
+
+	ctx, end := fs.startOp(context.Background(), "Write")
+	_, span = startSpan(ctx, "rados.Write")
+	endSpan(span, nil)
+	err := error(syscall.EIO)
+	end(&err)
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("%v spans, want 2", len(spans))
+	}
+	child, op := spans[0], spans[1]
+	if op.Name() != "Write" || child.Name() != "rados.Write" {
+		t.Fatalf("spans %v and %v, want Write and rados.Write", op.Name(), child.Name())
+	}
+	if child.Parent().SpanID() != op.SpanContext().SpanID() {
+		t.Error("backend span isn't a child of the operation")
+	}
+	if len(op.Events()) == 0 {
+		t.Error("error of the operation isn't recorded")
+	}
+}
+
+func TestNotifySpan(t *testing.T) {
+	fs, _ := NewORFS("a", "a", 10)
+	rec := tracetest.NewSpanRecorder()
+	fs.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	ctx, end := fs.startOp(context.Background(), "Mkdir")
+	fs.sendNotify(ctx, uuid.New(), true, notifyChange, "a")
+	var err error
+	end(&err)
+	spans := rec.Ended()
+	if len(spans) != 2 || spans[0].Name() != "rados.Notify" {
+		t.Fatalf("%v spans, want rados.Notify under Mkdir", len(spans))
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Error("notify span isn't a child of the operation")
+	}
+}
@@ -0,0 +1,180 @@
+package orfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+)
+
+// Directories are kept coherent between clients with RADOS watch/notify.
+// Every client watches the directory objects it has read, whoever changes a
+// directory notifies its watchers, which drop their copy so the next access
+// reads it again. A watched directory that hasn't been notified is known to
+// be current and is used without asking RADOS. File inodes are watched while
+// a File holds a lease on them, see lease.go.
+
+// How long a notify waits for the watchers to acknowledge it.
+const notifyTimeout = 5 * time.Second
+
+// Kinds of notifies, a change of a directory or a request to give up the
+// leases on an inode.
+const (
+	notifyChange = 'c'
+	notifyRevoke = 'r'
+)
+
+// inodeWatch is a watch and the release of the connection it is on.
+type inodeWatch struct {
+	*rados.Watcher
+	release func()
+}
+
+func (w *inodeWatch) stop() {
+	w.Delete()
+	w.release()
+}
+
+// watch starts watching the inode unless it is watched already, it reports
+// whether the inode is watched.
+func (fs *Orfs) watch(inode uuid.UUID, isDir bool) bool {
+	fs.watchMu.Lock()
+	defer fs.watchMu.Unlock()
+	if _, ok := fs.watches[inode]; ok {
+		return true
+	}
+	ioctx, _, release, err := fs.connection(isDir)
+	if err != nil {
+		return false
+	}
+	rw, err := ioctx.Watch(inode.String())
+	if err != nil {
+		release()
+		fs.logger.Debug("Watch failed", "inode", inode, "error", err)
+		return false
+	}
+	w := &inodeWatch{rw, release}
+	fs.watches[inode] = w
+	go fs.handleWatch(inode, w)
+	return true
+}
+
+// unwatch stops watching inode, unless a File holds a lease on it.
+func (fs *Orfs) unwatch(inode uuid.UUID) {
+	fs.watchMu.Lock()
+	if fs.hasLeases(inode) {
+		fs.watchMu.Unlock()
+		return
+	}
+	w, ok := fs.watches[inode]
+	delete(fs.watches, inode)
+	fs.watchMu.Unlock()
+	if ok {
+		w.stop()
+	}
+}
+
+// dropWatch deletes the failed watch w of inode. Reconnecting may have
+// replaced it already, a new watch is kept.
+func (fs *Orfs) dropWatch(inode uuid.UUID, w *inodeWatch) {
+	fs.watchMu.Lock()
+	current := fs.watches[inode] == w
+	if current {
+		delete(fs.watches, inode)
+	}
+	fs.watchMu.Unlock()
+	if current {
+		w.stop()
+	}
+}
+
+// handleWatch invalidates inode on notifies from other clients. If the
+// watch fails notifies may have been missed, so the inode is invalidated
+// and the watch dropped, the next read of the inode watches it again.
+func (fs *Orfs) handleWatch(inode uuid.UUID, w *inodeWatch) {
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				return
+			}
+			sender, kind, name := parseNotify(ev.Data)
+			if kind == notifyRevoke {
+				// Our own Files may hold conflicting leases as well.
+				fs.revokeLeases(inode)
+			} else if sender != fs.id {
+				fs.logger.Debug("Notified", "inode", inode, "name", name)
+				fs.invalidate(inode)
+			}
+			ev.Ack(nil)
+		case err, ok := <-w.Errors():
+			if !ok {
+				return
+			}
+			fs.logger.Warn("Watch error", "inode", inode, "error", err)
+			fs.invalidate(inode)
+			fs.revokeLeases(inode)
+			fs.dropWatch(inode, w)
+			return
+		}
+	}
+}
+
+// invalidate makes the next ReadMD of inode read it from RADOS.
+func (fs *Orfs) invalidate(inode uuid.UUID) {
+	var objs []*fsObj
+	if o, ok := fs.cache.Peek(inode); ok {
+		if f, ok := o.(*fsObj); ok {
+			objs = append(objs, f)
+		}
+	}
+	if f, ok := fs.Root.(*fsObj); ok && f.Inode() == inode {
+		objs = append(objs, f)
+	}
+	for _, f := range objs {
+		f.Lock()
+		f.coherent = false
+		f.lastRead = time.Time{}
+		f.Unlock()
+	}
+}
+
+// notify tells the other clients watching the directory that its entry name
+// changed.
+func (f *fsObj) notify(ctx context.Context, name string) {
+	if !f.IsDir() {
+		return
+	}
+	f.fs.sendNotify(ctx, f.Inode(), true, notifyChange, name)
+}
+
+func (fs *Orfs) sendNotify(ctx context.Context, inode uuid.UUID, isDir bool, kind byte, name string) {
+	pool := fs.pool
+	if isDir {
+		pool = fs.mdpool
+	}
+	_, span := startSpan(ctx, "rados.Notify",
+		attribute.String("orfs.inode", inode.String()),
+		attribute.String("rados.pool", pool),
+		attribute.String("rados.object", inode.String()))
+	data := []byte(fmt.Sprintf("%v;%c;%v", fs.id, kind, name))
+	err := fs.call(isDir, func(ioctx *rados.IOContext) error {
+		_, _, err := ioctx.Notify(inode.String(), data, notifyTimeout)
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		fs.logger.Debug("Notify failed", "inode", inode, "error", err)
+	}
+}
+
+func parseNotify(data []byte) (sender string, kind byte, name string) {
+	parts := strings.SplitN(string(data), ";", 3)
+	if len(parts) != 3 || len(parts[1]) != 1 {
+		return "", 0, ""
+	}
+	return parts[0], parts[1][0], parts[2]
+}
@@ -0,0 +1,186 @@
+package orfs
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// writeBuffer holds data written to a File which isn't written to RADOS
+// yet. Writes continuing where the buffered data ends are coalesced, the
+// buffer is written out when it reaches size bytes, delay after the first
+// write to it, before anything reads the file or on Sync and Close.
+type writeBuffer struct {
+	mu    sync.Mutex
+	size  int
+	delay time.Duration
+	off   int64
+	data  []byte
+	// Set if the file is opened with O_APPEND, off is then unused and the
+	// data is appended at the end of the file.
+	append bool
+	timer  *time.Timer
+	// Error of a flush run by the timer, returned by the next call which
+	// flushes.
+	err error
+}
+
+// SetWriteBuffer enables buffering of writes to the file, up to size bytes
+// are kept in memory for at most delay before they are written. Buffered
+// writes succeed before the data is in RADOS, errors writing it are returned
+// by a later Write, Sync or Close. A size of 0 flushes the buffer and turns
+// buffering off.
+func (f *File) SetWriteBuffer(size int, delay time.Duration) (err error) {
+	defer pathError("write", f.path, &err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	err = f.flush(context.Background())
+	if size < 0 {
+		size = 0
+	}
+	f.wb.mu.Lock()
+	f.wb.size, f.wb.delay = size, delay
+	f.wb.mu.Unlock()
+	return err
+}
+
+// buffered reports whether writes are buffered.
+func (f *File) buffered() bool {
+	f.wb.mu.Lock()
+	defer f.wb.mu.Unlock()
+	return f.wb.size > 0
+}
+
+// bufferWrite adds p to the write buffer, the caller holds f.mu.
+func (f *File) bufferWrite(ctx context.Context, p []byte) (int, error) {
+	wb := &f.wb
+	wb.mu.Lock()
+	appending := f.flag&os.O_APPEND != 0
+	if len(wb.data) > 0 && !appending && wb.off+int64(len(wb.data)) != f.pos {
+		// Not contiguous with the buffered data.
+		if err := f.flushLocked(ctx, wb); err != nil {
+			wb.mu.Unlock()
+			return 0, err
+		}
+	}
+	if err := wb.err; err != nil {
+		wb.err = nil
+		wb.mu.Unlock()
+		return 0, err
+	}
+	if len(wb.data) == 0 {
+		wb.off, wb.append = f.pos, appending
+	}
+	wb.data = append(wb.data, p...)
+	if appending {
+		f.pos = f.Inode.Size() + int64(len(wb.data))
+	} else {
+		f.pos += int64(len(p))
+	}
+
+	var err error
+	if len(wb.data) >= wb.size {
+		err = f.flushLocked(ctx, wb)
+	} else if wb.timer == nil && wb.delay > 0 {
+		wb.timer = time.AfterFunc(wb.delay, func() {
+			f.flushTimer(wb)
+		})
+	}
+	wb.mu.Unlock()
+	return len(p), err
+}
+
+// flush writes out the buffered data, it returns the error of an earlier
+// flush if there was one.
+func (f *File) flush(ctx context.Context) error {
+	wb := &f.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	err := f.flushLocked(ctx, wb)
+	if wb.err != nil {
+		err, wb.err = wb.err, nil
+	}
+	return err
+}
+
+// flushTimer writes out the buffer once its delay is over. The lease may have
+// expired or been lost since the data was buffered, so it is held again
+// first, or the leases of the others are revoked after writing.
+func (f *File) flushTimer(wb *writeBuffer) {
+	fs := f.Inode.fs
+	f.lease.mu.Lock()
+	defer f.lease.mu.Unlock()
+	wb.mu.Lock()
+	empty := len(wb.data) == 0
+	wb.mu.Unlock()
+	if empty || fs.bg.Err() != nil {
+		// Flushed since, or the Orfs is closing. Taking the lease again
+		// would outlive a Close.
+		return
+	}
+	leased := f.holdLease(leaseExclusive)
+	wb.mu.Lock()
+	if err := f.flushLocked(fs.bg, wb); err != nil {
+		wb.err = err
+	}
+	wb.mu.Unlock()
+	if !leased {
+		fs.sendNotify(fs.bg, f.Inode.Inode(), false, notifyRevoke, "")
+	}
+}
+
+// flushLocked is flush with wb.mu held.
+func (f *File) flushLocked(ctx context.Context, wb *writeBuffer) error {
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+	if len(wb.data) == 0 {
+		return nil
+	}
+	f.Inode.fs.logger.Debug("Flush", "inode", f.Inode.Inode(), "off", wb.off, "len", len(wb.data))
+	var err error
+	if wb.append {
+		_, _, err = f.Inode.appendBlocks(ctx, wb.data)
+	} else {
+		_, err = f.Inode.writeBlocks(ctx, wb.data, wb.off)
+	}
+	// Like a failed write-back in the kernel the data is dropped, the error
+	// is reported once.
+	wb.data = wb.data[:0]
+	return err
+}
+
+// Sync writes out buffered data and records the size and modification time
+// of the file in its inode and in the directory entry it was opened by. When
+// Sync returns without error the data and the size are persistent and
+// visible to other clients.
+func (f *File) Sync() error {
+	return f.SyncContext(context.Background())
+}
+
+// SyncContext is Sync with a context.
+func (f *File) SyncContext(ctx context.Context) (err error) {
+	defer pathError("sync", f.path, &err)
+	ctx, end := f.Inode.fs.startOp(ctx, "Sync", slog.Any("inode", f.Inode.Inode()))
+	defer end(&err)
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	if !f.writable() {
+		return nil
+	}
+	if err := f.flush(ctx); err != nil {
+		return err
+	}
+	changed, err := f.Inode.commit(ctx)
+	if err != nil || !changed || f.dir == nil {
+		return err
+	}
+	return f.dir.refreshEntry(ctx, f.name, f.Inode)
+}
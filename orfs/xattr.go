@@ -0,0 +1,377 @@
+package orfs
+
+import (
+	"context"
+	"github.com/ceph/go-ceph/rados"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Limits on extended attributes, the same as Linux uses.
+const (
+	XattrNameMax  = 255
+	XattrSizeMax  = 64 * 1024
+	XattrCountMax = 1024
+)
+
+// Flags for SetXattr, they match setxattr(2).
+const (
+	// Fail with syscall.EEXIST if the attribute already exists.
+	XattrCreate = 1 << iota
+	// Fail with syscall.ENODATA if the attribute doesn't exist.
+	XattrReplace
+)
+
+// Extended attributes are stored as RADOS xattrs on the inode object, the
+// prefix keeps them apart from any xattrs RADOS or ORFS use internally.
+const xattrPrefix = "xattr."
+
+var xattrNamespaces = []string{"user.", "trusted.", "security.", "system."}
+
+func validXattrName(attr string) error {
+	if len(attr) == 0 || len(attr) > XattrNameMax {
+		return syscall.ERANGE
+	}
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(attr, ns) && len(attr) > len(ns) {
+			return nil
+		}
+	}
+	return syscall.ENOTSUP
+}
+
+func xattrError(err error) error {
+	if err == rados.RadosError(-int(syscall.ENODATA)) {
+		return syscall.ENODATA
+	}
+	return err
+}
+
+// xattrCall runs call on the inode object in a span for the xattr call name.
+func (f *fsObj) xattrCall(ctx context.Context, name string, call func(ioctx *rados.IOContext) error) error {
+	_, span := f.radosSpan(ctx, name, f.Inode().String(), f.IsDir())
+	err := xattrError(f.fs.call(f.IsDir(), call))
+	endSpan(span, err)
+	return err
+}
+
+// Sets the extended attribute attr to value.
+func (f *fsObj) SetXattr(attr string, value []byte, flags int) error {
+	return f.setXattr(context.Background(), attr, value, flags)
+}
+
+// setXattrContext is SetXattr with a context.
+func setXattrContext(ctx context.Context, obj OBJ, attr string, value []byte, flags int) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.setXattr(ctx, attr, value, flags)
+	}
+	return obj.SetXattr(attr, value, flags)
+}
+
+func (f *fsObj) setXattr(ctx context.Context, attr string, value []byte, flags int) error {
+	if err := validXattrName(attr); err != nil {
+		return err
+	}
+	if len(value) > XattrSizeMax {
+		return syscall.E2BIG
+	}
+	// The checks of the flags and the count only hold with the inode
+	// locked, like all its updates.
+	err := f.locked(ctx, func(ioctx *rados.IOContext) error {
+		xattrs, err := f.listXattrs(ctx)
+		if err != nil {
+			return err
+		}
+		_, exists := xattrs[attr]
+		if exists && flags&XattrCreate != 0 {
+			return syscall.EEXIST
+		}
+		if !exists && flags&XattrReplace != 0 {
+			return syscall.ENODATA
+		}
+		if !exists && len(xattrs) >= XattrCountMax {
+			return syscall.ENOSPC
+		}
+		if attr == XattrACLAccess || attr == XattrACLDefault {
+			return f.setACLXattr(ctx, ioctx, attr, value)
+		}
+		f.fs.logger.Debug("SetXattr", "inode", f.Inode(), "attr", attr, "len", len(value))
+		return f.xattrCall(ctx, "rados.SetXattr", func(ioctx *rados.IOContext) error {
+			return ioctx.SetXattr(f.Inode().String(), xattrPrefix+attr, value)
+		})
+	})
+	if err == nil && attr == XattrACLAccess {
+		// The mode changed.
+		f.notify(ctx, "")
+	}
+	return err
+}
+
+// Returns the value of the extended attribute attr.
+func (f *fsObj) GetXattr(attr string) ([]byte, error) {
+	return f.getXattr(context.Background(), attr)
+}
+
+// getXattrContext is GetXattr with a context.
+func getXattrContext(ctx context.Context, obj OBJ, attr string) ([]byte, error) {
+	if o, ok := obj.(*fsObj); ok {
+		return o.getXattr(ctx, attr)
+	}
+	return obj.GetXattr(attr)
+}
+
+func (f *fsObj) getXattr(ctx context.Context, attr string) ([]byte, error) {
+	if err := validXattrName(attr); err != nil {
+		return nil, err
+	}
+	if attr == XattrACLAccess || attr == XattrACLDefault {
+		return f.getACLXattr(ctx, attr)
+	}
+	buf := make([]byte, XattrSizeMax)
+	var n int
+	err := f.xattrCall(ctx, "rados.GetXattr", func(ioctx *rados.IOContext) (err error) {
+		n, err = ioctx.GetXattr(f.Inode().String(), xattrPrefix+attr, buf)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Returns the names of all extended attributes, sorted.
+func (f *fsObj) ListXattr() ([]string, error) {
+	return f.listXattr(context.Background())
+}
+
+// listXattrContext is ListXattr with a context.
+func listXattrContext(ctx context.Context, obj OBJ) ([]string, error) {
+	if o, ok := obj.(*fsObj); ok {
+		return o.listXattr(ctx)
+	}
+	return obj.ListXattr()
+}
+
+func (f *fsObj) listXattr(ctx context.Context) ([]string, error) {
+	xattrs, err := f.listXattrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Removes the extended attribute attr.
+func (f *fsObj) RemoveXattr(attr string) error {
+	return f.removeXattr(context.Background(), attr)
+}
+
+// removeXattrContext is RemoveXattr with a context.
+func removeXattrContext(ctx context.Context, obj OBJ, attr string) error {
+	if o, ok := obj.(*fsObj); ok {
+		return o.removeXattr(ctx, attr)
+	}
+	return obj.RemoveXattr(attr)
+}
+
+func (f *fsObj) removeXattr(ctx context.Context, attr string) error {
+	if err := validXattrName(attr); err != nil {
+		return err
+	}
+	return f.locked(ctx, func(*rados.IOContext) error {
+		xattrs, err := f.listXattrs(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := xattrs[attr]; !ok {
+			return syscall.ENODATA
+		}
+		f.Lock()
+		f.aclLoaded = false
+		f.Unlock()
+		return f.xattrCall(ctx, "rados.RmXattr", func(ioctx *rados.IOContext) error {
+			return ioctx.RmXattr(f.Inode().String(), xattrPrefix+attr)
+		})
+	})
+}
+
+// listXattrs returns the extended attributes of the inode without the
+// prefix.
+func (f *fsObj) listXattrs(ctx context.Context) (map[string][]byte, error) {
+	var all map[string][]byte
+	err := f.xattrCall(ctx, "rados.ListXattrs", func(ioctx *rados.IOContext) (err error) {
+		all, err = ioctx.ListXattrs(f.Inode().String())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for name, value := range all {
+		if strings.HasPrefix(name, xattrPrefix) {
+			xattrs[strings.TrimPrefix(name, xattrPrefix)] = value
+		}
+	}
+	return xattrs, nil
+}
+
+// xattrAccess checks that c may read or, if write is set, change the
+// extended attribute attr of obj. trusted.* is reserved for the superuser,
+// security.* and system.* may only be changed by the owner.
+func (c *Caller) xattrAccess(obj OrfsStat, attr string, write bool) error {
+	if c.isSuperuser() {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(attr, "trusted."):
+		return os.ErrPermission
+	case !write:
+		return c.access(obj, permRead)
+	case strings.HasPrefix(attr, "user."):
+		return c.access(obj, permWrite)
+	}
+	return c.owns(obj)
+}
+
+// Sets the extended attribute attr on the file or directory name.
+func (fs *Orfs) SetXattr(name, attr string, value []byte, flags int) error {
+	return fs.SetXattrContext(context.Background(), name, attr, value, flags)
+}
+
+// SetXattrContext is SetXattr with a context, see WithCaller.
+func (fs *Orfs) SetXattrContext(ctx context.Context, name, attr string, value []byte, flags int) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("setxattr", name, &err)
+	ctx, end := fs.startOp(ctx, "SetXattr", slog.String("path", name), slog.String("attr", attr))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if err := c.xattrAccess(obj, attr, true); err != nil {
+		return err
+	}
+	return setXattrContext(ctx, obj, attr, value, flags)
+}
+
+// Sets the extended attribute attr on name as c.
+func (fs *Orfs) SetXattrAs(c *Caller, name, attr string, value []byte, flags int) error {
+	return fs.SetXattrContext(WithCaller(context.Background(), c), name, attr, value, flags)
+}
+
+// Returns the extended attribute attr of the file or directory name.
+func (fs *Orfs) GetXattr(name, attr string) ([]byte, error) {
+	return fs.GetXattrContext(context.Background(), name, attr)
+}
+
+// GetXattrContext is GetXattr with a context, see WithCaller.
+func (fs *Orfs) GetXattrContext(ctx context.Context, name, attr string) (_ []byte, err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("getxattr", name, &err)
+	ctx, end := fs.startOp(ctx, "GetXattr", slog.String("path", name), slog.String("attr", attr))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.xattrAccess(obj, attr, false); err != nil {
+		return nil, err
+	}
+	return getXattrContext(ctx, obj, attr)
+}
+
+// Returns the extended attribute attr of name as c.
+func (fs *Orfs) GetXattrAs(c *Caller, name, attr string) ([]byte, error) {
+	return fs.GetXattrContext(WithCaller(context.Background(), c), name, attr)
+}
+
+// Lists the extended attributes of the file or directory name.
+func (fs *Orfs) ListXattr(name string) ([]string, error) {
+	return fs.ListXattrContext(context.Background(), name)
+}
+
+// ListXattrContext is ListXattr with a context, see WithCaller.
+func (fs *Orfs) ListXattrContext(ctx context.Context, name string) (_ []string, err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("listxattr", name, &err)
+	ctx, end := fs.startOp(ctx, "ListXattr", slog.String("path", name))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	names, err := listXattrContext(ctx, obj)
+	if err != nil || c.isSuperuser() {
+		return names, err
+	}
+	visible := names[:0]
+	for _, attr := range names {
+		if !strings.HasPrefix(attr, "trusted.") {
+			visible = append(visible, attr)
+		}
+	}
+	return visible, nil
+}
+
+// Lists the extended attributes of name as c, trusted.* attributes are
+// only listed for the superuser.
+func (fs *Orfs) ListXattrAs(c *Caller, name string) ([]string, error) {
+	return fs.ListXattrContext(WithCaller(context.Background(), c), name)
+}
+
+// Removes the extended attribute attr from the file or directory name.
+func (fs *Orfs) RemoveXattr(name, attr string) error {
+	return fs.RemoveXattrContext(context.Background(), name, attr)
+}
+
+// RemoveXattrContext is RemoveXattr with a context, see WithCaller.
+func (fs *Orfs) RemoveXattrContext(ctx context.Context, name, attr string) (err error) {
+	c := CallerFromContext(ctx)
+	defer pathError("removexattr", name, &err)
+	ctx, end := fs.startOp(ctx, "RemoveXattr", slog.String("path", name), slog.String("attr", attr))
+	defer end(&err)
+	obj, err := fs.GetObjectContext(ctx, name, false)
+	if err != nil {
+		return err
+	}
+	if err := c.xattrAccess(obj, attr, true); err != nil {
+		return err
+	}
+	return removeXattrContext(ctx, obj, attr)
+}
+
+// Removes the extended attribute attr from name as c.
+func (fs *Orfs) RemoveXattrAs(c *Caller, name, attr string) error {
+	return fs.RemoveXattrContext(WithCaller(context.Background(), c), name, attr)
+}
+
+// Sets the extended attribute attr on the open file.
+func (f *File) SetXattr(attr string, value []byte, flags int) (err error) {
+	defer pathError("setxattr", f.path, &err)
+	return f.Inode.SetXattr(attr, value, flags)
+}
+
+// Returns the extended attribute attr of the open file.
+func (f *File) GetXattr(attr string) (_ []byte, err error) {
+	defer pathError("getxattr", f.path, &err)
+	return f.Inode.GetXattr(attr)
+}
+
+// Lists the extended attributes of the open file.
+func (f *File) ListXattr() (_ []string, err error) {
+	defer pathError("listxattr", f.path, &err)
+	return f.Inode.ListXattr()
+}
+
+// Removes the extended attribute attr from the open file.
+func (f *File) RemoveXattr(attr string) (err error) {
+	defer pathError("removexattr", f.path, &err)
+	return f.Inode.RemoveXattr(attr)
+}
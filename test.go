@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/cetex/ORFS/orfs"
+	"log/slog"
 	"os"
 )
 
 func main() {
-	fs := orfs.NewORFS("test", "test_metadata", 100000)
-	fs.SetDebugLog(os.Stdout)
-	fs.SetLog(os.Stderr)
+	fs, err := orfs.New(orfs.Config{
+		Pool:         "test",
+		MetadataPool: "test_metadata",
+		Logger:       slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	if err != nil {
+		panic(err)
+	}
 	if err := fs.Connect(); err != nil {
 		panic(err)
 	}
+	defer fs.Close(context.Background())
 	list, err := fs.Root.List()
 	if err != nil {
 		panic(err)